@@ -21,6 +21,8 @@
 package cmd
 
 import (
+	"context"
+	"net/http"
 	"runtime"
 	"strings"
 	"time"
@@ -37,13 +39,41 @@ import (
 )
 
 var (
-	marathonHost    string
-	marathonLabel   string
-	influxAddress   string
-	influxDB        string
-	influxRetention string
-	numWorkers      uint
-	extraTags       string
+	marathonHost       string
+	marathonLabel      string
+	influxAddress      string
+	influxDB           string
+	influxRetention    string
+	influxUsername     string
+	influxPassword     string
+	influxPasswordFile string
+	influxTLS          metrics.TLSConfig
+	numWorkers         uint
+	extraTags          string
+	interval           time.Duration
+	stateFile          string
+
+	prometheusListen     string
+	prometheusStaleAfter time.Duration
+
+	reportCardinality bool
+	stdout            bool
+	failOnPartial     float64
+)
+
+// exit codes of a failed fetch
+const (
+	exitConfigFailure    = 1
+	exitDiscoveryFailure = 2
+	exitScrapeFailure    = 3
+	exitPushFailure      = 4
+)
+
+// environment variables with the InfluxDB credentials used when they are not configured
+const (
+	envInfluxUsername = "INFLUXDB_USERNAME"
+	envInfluxPassword = "INFLUXDB_PASSWORD"
+	envInfluxToken    = "INFLUXDB_TOKEN"
 )
 
 // fetchCmd represents the fetch command
@@ -55,29 +85,133 @@ tag to process. Then it calls the very last port defined on the service (assumin
 to fetch metrics. Then it aggregates those metrics by a service id and sends them back to Influx
 For now it supports only Influx line protocol.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		serviceRegistry, err := registry.NewMarathonRegistry(marathonHost, numWorkers, nil)
+		rawFilters := []models.Filter{}
+		err := viper.UnmarshalKey("filters", &rawFilters)
+
 		if err != nil {
-			log.Error(err)
-			return
+			err = errors.Wrap(err, 0)
+			log.WithError(err).Error("Error loading filters from configuration")
+			os.Exit(exitConfigFailure)
 		}
-		log.WithField("marathon_lable", marathonLabel).Info("Getting services for measurement")
-		services, err := serviceRegistry.GetServices(marathonLabel)
+
+		filters, err := models.NewFilters(rawFilters)
 		if err != nil {
-			log.WithError(err).Error("Erorr getting list of services")
-			return
+			log.WithError(err).Error("Invalid filters in configuration")
+			os.Exit(exitConfigFailure)
 		}
 
-		// gathering metrics
-		log.Infof("Fetching metrics from services: %d", len(services))
-		grouppedMetrics := metrics.GatherServiceMetrics(services, numWorkers)
+		rawDerived := []models.Derived{}
+		err = viper.UnmarshalKey("derived", &rawDerived)
+		if err != nil {
+			err = errors.Wrap(err, 0)
+			log.WithError(err).Error("Error loading derived metrics from configuration")
+			os.Exit(exitConfigFailure)
+		}
 
-		filters := []models.Filter{}
-		err = viper.UnmarshalKey("filters", &filters)
+		derived, err := models.NewDerivedMetrics(rawDerived)
+		if err != nil {
+			log.WithError(err).Error("Invalid derived metrics in configuration")
+			os.Exit(exitConfigFailure)
+		}
 
+		relabeling := models.Relabeling{}
+		err = viper.UnmarshalKey("relabel", &relabeling)
 		if err != nil {
 			err = errors.Wrap(err, 0)
-			log.WithError(err).Error("Error loading filters from configuration")
-			return
+			log.WithError(err).Error("Error loading relabel rules from configuration")
+			os.Exit(exitConfigFailure)
+		}
+
+		serviceRelabel, err := models.NewServiceRelabelRules(relabeling.Services)
+		if err != nil {
+			log.WithError(err).Error("Invalid services relabel rules in configuration")
+			os.Exit(exitConfigFailure)
+		}
+
+		metricRelabel, err := models.NewRelabelRules(relabeling.Metrics)
+		if err != nil {
+			log.WithError(err).Error("Invalid metrics relabel rules in configuration")
+			os.Exit(exitConfigFailure)
+		}
+
+		appID := registry.AppIDMapping{}
+		err = viper.UnmarshalKey("app_id", &appID)
+		if err != nil {
+			err = errors.Wrap(err, 0)
+			log.WithError(err).Error("Error loading app ID mapping from configuration")
+			os.Exit(exitConfigFailure)
+		}
+
+		limits := metrics.Limits{}
+		err = viper.UnmarshalKey("limits", &limits)
+		if err != nil {
+			err = errors.Wrap(err, 0)
+			log.WithError(err).Error("Error loading limits from configuration")
+			os.Exit(exitConfigFailure)
+		}
+
+		sinkConfigs := []metrics.SinkConfig{}
+		err = viper.UnmarshalKey("sinks", &sinkConfigs)
+		if err != nil {
+			err = errors.Wrap(err, 0)
+			log.WithError(err).Error("Error loading sinks from configuration")
+			os.Exit(exitConfigFailure)
+		}
+
+		for _, sinkConfig := range sinkConfigs {
+			defaultCredentials(sinkConfig)
+		}
+
+		sinks, err := metrics.NewSinks(sinkConfigs)
+		if err != nil {
+			log.WithError(err).Error("Invalid sinks in configuration")
+			os.Exit(exitConfigFailure)
+		}
+		// without configured sinks the metrics go to stdout and the InfluxDB given by the flags
+		if sinks.Len() == 0 {
+			if stdout {
+				stdoutSink, err := metrics.NewStdoutSink(nil, "")
+				if err == nil {
+					err = sinks.Add(metrics.SinkStdout, stdoutSink)
+				}
+				if err != nil {
+					log.WithError(err).Error("Error adding stdout sink")
+					os.Exit(exitConfigFailure)
+				}
+			}
+			if len(influxAddress) != 0 {
+				if len(influxUsername) == 0 {
+					influxUsername = os.Getenv(envInfluxUsername)
+				}
+				if len(influxPassword) == 0 && len(influxPasswordFile) == 0 {
+					influxPassword = os.Getenv(envInfluxPassword)
+				}
+				influxSink, err := metrics.NewInfluxSink(metrics.InfluxConfig{
+					Address:      influxAddress,
+					Database:     influxDB,
+					Retention:    influxRetention,
+					Username:     influxUsername,
+					Password:     influxPassword,
+					PasswordFile: influxPasswordFile,
+					TLS:          influxTLS,
+				})
+				if err != nil {
+					log.WithError(err).Error("Invalid InfluxDB options")
+					os.Exit(exitConfigFailure)
+				}
+				if err = sinks.Add(metrics.SinkInfluxDB, influxSink); err != nil {
+					log.WithError(err).Error("Error adding InfluxDB sink")
+					os.Exit(exitConfigFailure)
+				}
+			}
+		}
+
+		inputConfig := metrics.InputConfig{}
+		err = viper.UnmarshalKey("inputs", &inputConfig)
+		if err != nil {
+			err = errors.Wrap(err, 0)
+			log.WithError(err).Error("Error loading inputs from configuration")
+			os.Exit(exitConfigFailure)
 		}
 
 		tags := map[string]string{}
@@ -90,28 +224,208 @@ For now it supports only Influx line protocol.`,
 			}
 		}
 
-		combinedMetrics, _ := metrics.Combine(grouppedMetrics, filters)
-		metrics.OutputMetrics(combinedMetrics, tags, os.Stdout)
+		p := pipeline{
+			appID:          appID,
+			filters:        filters,
+			derived:        derived,
+			serviceRelabel: serviceRelabel,
+			metricRelabel:  metricRelabel,
+			limits:         limits,
+			sinks:          sinks,
+			inputs:         metrics.NewInputs(inputConfig, filters),
+			tags:           tags,
+		}
 
-		if len(influxAddress) != 0 {
-			log.WithField("server", influxAddress).Info("Sending metrics to database")
-			err = metrics.SendMetrics(influxAddress, influxDB, influxRetention, "", "", combinedMetrics, tags, time.Now())
+		if len(stateFile) != 0 {
+			p.rates, err = metrics.LoadRates(stateFile, filters)
 			if err != nil {
-				log.WithError(err).Error("Error sending metrics")
-				return
+				log.WithError(err).WithField("state_file", stateFile).Error("Error loading previous counter samples")
+			}
+		} else if interval > 0 {
+			p.rates = metrics.NewRates(filters)
+		}
+
+		if interval <= 0 {
+			if len(prometheusListen) != 0 {
+				log.Warn("Prometheus exporter is available only in daemon mode (--interval)")
+			}
+			if code := fetch(p); code != 0 {
+				os.Exit(code)
+			}
+			return
+		}
+
+		log.WithField("interval", interval).Info("Running in daemon mode")
+		if len(prometheusListen) != 0 {
+			exporter := metrics.NewPrometheusExporter(metrics.PrometheusConfig{StaleAfter: prometheusStaleAfter})
+			if err = sinks.Add("prometheus", exporter); err != nil {
+				log.WithError(err).Error("Error adding Prometheus exporter")
+				os.Exit(exitConfigFailure)
 			}
+			go servePrometheus(exporter)
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			fetch(p)
+			<-ticker.C
 		}
 	},
 }
 
+// pipeline holds configuration of the fetch cycle loaded once at startup
+type pipeline struct {
+	appID          registry.AppIDMapping
+	filters        models.Filters
+	derived        models.DerivedMetrics
+	serviceRelabel models.RelabelRules
+	metricRelabel  models.RelabelRules
+	limits         metrics.Limits
+	sinks          *metrics.Sinks
+	inputs         metrics.Inputs
+	rates          *metrics.Rates
+	tags           map[string]string
+}
+
+// fetch runs a single fetch cycle: discovery, gathering, processing and sending of the metrics. It returns
+// non-zero exit code when any of the stages failed.
+func fetch(p pipeline) int {
+	serviceRegistry, err := registry.NewMarathonRegistry(marathonHost, numWorkers, nil)
+	if err != nil {
+		log.Error(err)
+		return exitDiscoveryFailure
+	}
+	serviceRegistry.AppID = p.appID
+	log.WithField("marathon_lable", marathonLabel).Info("Getting services for measurement")
+	services, err := serviceRegistry.GetServices(marathonLabel)
+	if err != nil {
+		log.WithError(err).Error("Error getting list of services")
+		return exitDiscoveryFailure
+	}
+
+	services = p.serviceRelabel.Services(services)
+
+	// gathering metrics
+	log.Infof("Fetching metrics from services: %d", len(services))
+	grouppedMetrics := metrics.GatherServiceMetrics(services, p.inputs, numWorkers)
+	now := time.Now()
+
+	code := 0
+	scraped := 0
+	for _, instances := range grouppedMetrics {
+		scraped += len(instances)
+	}
+	if scraped < len(services) {
+		log.WithFields(log.Fields{"services": len(services), "failed": len(services) - scraped}).Error("Error scraping some of the services")
+		code = exitScrapeFailure
+	}
+
+	if p.rates != nil {
+		p.rates.Apply(grouppedMetrics, now)
+		if len(stateFile) != 0 {
+			if err = p.rates.Save(stateFile); err != nil {
+				log.WithError(err).WithField("state_file", stateFile).Error("Error saving counter samples")
+			}
+		}
+	}
+
+	combinedMetrics, filterDrops := p.filters.CombineLimited(grouppedMetrics)
+	combinedMetrics, _ = metrics.Derive(combinedMetrics, p.derived)
+	combinedMetrics = p.metricRelabel.Metrics(combinedMetrics)
+	combinedMetrics, summary := metrics.LimitSeries(combinedMetrics, p.limits)
+	summary.DroppedByFilter = filterDrops
+	defer summary.Log()
+
+	if reportCardinality {
+		metrics.ReportCardinality(combinedMetrics, os.Stdout)
+		return code
+	}
+
+	err = p.sinks.Write(context.Background(), combinedMetrics, p.tags, now)
+	for name, stats := range p.sinks.Stats() {
+		log.WithFields(log.Fields{"sink": name, "writes": stats.Writes, "failures": stats.Failures, "points": stats.Points}).Info("Sink statistics")
+	}
+	if err != nil && pushFailed(err) {
+		log.WithError(err).Error("Error sending metrics")
+		return exitPushFailure
+	}
+
+	return code
+}
+
+// servePrometheus exposes the latest metrics on /metrics of --prometheus-listen address
+// defaultCredentials fills the not configured credentials of the InfluxDB sinks from the environment
+func defaultCredentials(config metrics.SinkConfig) {
+	setDefault := func(key string, file string, env string) {
+		if config[key] != nil || config[file] != nil {
+			return
+		}
+		if value := os.Getenv(env); len(value) != 0 {
+			config[key] = value
+		}
+	}
+
+	switch config["type"] {
+	case metrics.SinkInfluxDB:
+		setDefault("username", "", envInfluxUsername)
+		setDefault("password", "password_file", envInfluxPassword)
+	case metrics.SinkInfluxDB2:
+		setDefault("token", "token_file", envInfluxToken)
+	}
+}
+
+func servePrometheus(exporter *metrics.PrometheusExporter) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+
+	log.WithField("address", prometheusListen).Info("Serving Prometheus metrics")
+	if err := http.ListenAndServe(prometheusListen, mux); err != nil {
+		log.WithError(err).WithField("address", prometheusListen).Fatal("Error serving Prometheus metrics")
+	}
+}
+
+// pushFailed tells whether any of the sinks failed, partial writes are tolerated up to --fail-on-partial fraction
+// of dropped points
+func pushFailed(err error) bool {
+	sinkErrors, ok := err.(metrics.SinkErrors)
+	if !ok {
+		return true
+	}
+
+	for name, sinkErr := range sinkErrors {
+		writeErr, ok := sinkErr.(*metrics.WriteError)
+		if !ok || writeErr.Kind != metrics.WriteErrorPartial || writeErr.DroppedRatio() > failOnPartial {
+			return true
+		}
+		log.WithError(writeErr).WithField("sink", name).Warn("Partial write below the --fail-on-partial threshold")
+	}
+
+	return false
+}
+
 func init() {
 	fetchCmd.Flags().StringVar(&marathonHost, "marathon", "http://localhost:8080", "address of a marathon API to connect to")
 	fetchCmd.Flags().StringVar(&marathonLabel, "label", "gather-metrics", "label to search services in marathon with")
 	fetchCmd.Flags().StringVar(&influxAddress, "influx", "", "address of an InfluxDB server where metrics should be pushed")
 	fetchCmd.Flags().StringVar(&influxDB, "database", "services", "name of the InfluxDB database")
 	fetchCmd.Flags().StringVar(&influxRetention, "retention", "default", "which retention policy should we use for pushing metrics")
+	fetchCmd.Flags().StringVar(&influxUsername, "username", "", "InfluxDB user name (default $INFLUXDB_USERNAME)")
+	fetchCmd.Flags().StringVar(&influxPassword, "password", "", "InfluxDB password (default $INFLUXDB_PASSWORD)")
+	fetchCmd.Flags().StringVar(&influxPasswordFile, "password-file", "", "file with the InfluxDB password")
+	fetchCmd.Flags().StringVar(&influxTLS.CA, "tls-ca", "", "PEM file with CA certificates verifying InfluxDB server")
+	fetchCmd.Flags().StringVar(&influxTLS.Cert, "tls-cert", "", "PEM file with the client certificate")
+	fetchCmd.Flags().StringVar(&influxTLS.Key, "tls-key", "", "PEM file with the client certificate key")
+	fetchCmd.Flags().BoolVar(&influxTLS.InsecureSkipVerify, "tls-insecure", false, "skip verification of InfluxDB server certificate")
 	fetchCmd.Flags().UintVar(&numWorkers, "workers", uint(runtime.NumCPU()*5), "how many fetcher workers to spawn")
 	fetchCmd.Flags().BoolVar(&silent, "silent", false, "suppress all logging")
 	fetchCmd.Flags().StringVar(&extraTags, "tags", "", "additional tags to add to all metrics (key=value,key2=value2)")
+	fetchCmd.Flags().DurationVar(&interval, "interval", 0, "run in daemon mode fetching metrics with a given interval (e.g. 1m)")
+	fetchCmd.Flags().StringVar(&prometheusListen, "prometheus-listen", "", "address serving the latest metrics to Prometheus on /metrics in daemon mode (e.g. :9100)")
+	fetchCmd.Flags().DurationVar(&prometheusStaleAfter, "prometheus-stale-after", 0, "how long series missing from the latest cycle are still exposed to Prometheus")
+	fetchCmd.Flags().StringVar(&stateFile, "state-file", "", "file keeping counter samples between runs, enables rate fields")
+	fetchCmd.Flags().BoolVar(&reportCardinality, "report-cardinality", false, "print number of series by measurement and tag keys instead of sending metrics")
+	fetchCmd.Flags().BoolVar(&stdout, "stdout", true, "write metrics to the standard output (when no sinks are configured)")
+	fetchCmd.Flags().Float64Var(&failOnPartial, "fail-on-partial", 0, "fraction of points dropped by a partial write (0-1) above which the push is considered failed")
 	RootCmd.AddCommand(fetchCmd)
 }
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+)
+
+const (
+	defaultExpvarPath = "/debug/vars"
+	expvarMemStats    = "memstats"
+)
+
+var defaultExpvarMemStats = []string{
+	"Alloc",
+	"TotalAlloc",
+	"Sys",
+	"Mallocs",
+	"Frees",
+	"HeapAlloc",
+	"HeapInuse",
+	"HeapObjects",
+	"StackInuse",
+	"NextGC",
+	"NumGC",
+	"PauseTotalNs",
+	"GCCPUFraction",
+}
+
+// ExpvarConfig holds configuration of the Go expvar input
+type ExpvarConfig struct {
+	// MemStats lists runtime.MemStats fields to be reported (a sensible default set is used when empty)
+	MemStats []string `mapstructure:"memstats"`
+	// Timeout of a request, 30s by default
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// ExpvarInput reads variables published by the Go expvar package.
+//
+// Every numeric variable becomes a gauge named by its dotted path, e.g. "http.requests.count".
+// From "memstats" only the selected fields are taken (named "memstats.<field>").
+type ExpvarInput struct {
+	memStats []string
+	timeout  time.Duration
+}
+
+// NewExpvarInput creates new instance of ExpvarInput
+func NewExpvarInput(config ExpvarConfig) ExpvarInput {
+	memStats := config.MemStats
+	if len(memStats) == 0 {
+		memStats = defaultExpvarMemStats
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultInputTimeout
+	}
+
+	return ExpvarInput{memStats: memStats, timeout: timeout}
+}
+
+// Fetch returns expvar variables of a given service
+func (e ExpvarInput) Fetch(serviceInfo models.ServiceInfo) (models.PandoraMetrics, error) {
+	metrics := models.PandoraMetrics{Gauges: map[string]models.PandoraGauge{}}
+
+	vars := map[string]json.RawMessage{}
+	if err := fetchJSON(serviceInfo.GetURL(defaultExpvarPath), e.timeout, &vars); err != nil {
+		return metrics, err
+	}
+
+	for name, value := range vars {
+		if name == expvarMemStats {
+			e.addMemStats(metrics.Gauges, serviceInfo, value)
+			continue
+		}
+
+		if err := flattenGauges(metrics.Gauges, name, value); err != nil {
+			log.WithError(err).WithFields(log.Fields{"task_id": serviceInfo.ID, "var": name}).Warn("Error decoding expvar - skipping")
+		}
+	}
+
+	return metrics, nil
+}
+
+func (e ExpvarInput) addMemStats(gauges map[string]models.PandoraGauge, serviceInfo models.ServiceInfo, raw json.RawMessage) {
+	memStats := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &memStats); err != nil {
+		log.WithError(err).WithField("task_id", serviceInfo.ID).Warn("Error decoding memstats - skipping")
+		return
+	}
+
+	for _, field := range e.memStats {
+		value, ok := memStats[field]
+		if !ok {
+			continue
+		}
+
+		if err := flattenGauges(gauges, expvarMemStats+"."+field, value); err != nil {
+			log.WithError(err).WithFields(log.Fields{"task_id": serviceInfo.ID, "field": field}).Warn("Error decoding memstats field - skipping")
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package metrics_test
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var expvarJson = `{
+"cmdline": ["/usr/bin/sidecar", "-port", "8080"],
+"http": {"requests": 1234, "errors": {"4xx": 12, "5xx": 1}, "healthy": true, "version": "1.2.3"},
+"goroutines": 27,
+"memstats": {"Alloc": 1048576, "TotalAlloc": 8388608, "Sys": 16777216, "HeapInuse": 2097152, "NumGC": 42, "GCCPUFraction": 0.0012, "PauseNs": [1000, 2000, 3000], "BySize": [{"Size": 8, "Mallocs": 10, "Frees": 5}]}
+}`
+
+var _ = Describe("ExpvarInput", func() {
+	var server *ghttp.Server
+	var services []models.ServiceInfo
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		serverHost, serverPort, _ := net.SplitHostPort(server.Addr())
+		serverPortInt, _ := strconv.ParseInt(serverPort, 10, 64)
+		services = []models.ServiceInfo{}
+		for _, id := range []string{"1", "2"} {
+			services = append(services, models.ServiceInfo{
+				Name:   "sidecar",
+				ID:     id,
+				Host:   serverHost,
+				Port:   serverPortInt,
+				Format: FormatExpvar,
+			})
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/debug/vars"),
+					ghttp.RespondWith(http.StatusOK, expvarJson),
+				),
+			)
+		}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("Fetch()", func() {
+		It("Should flatten variables and pick default memstats fields", func() {
+			metrics, err := NewExpvarInput(ExpvarConfig{}).Fetch(services[0])
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metrics.Gauges).To(HaveLen(11))
+			Expect(metrics.Gauges["http.requests"].Parse()).To(Equal(float64(1234)))
+			Expect(metrics.Gauges["http.errors.4xx"].Parse()).To(Equal(float64(12)))
+			Expect(metrics.Gauges["http.errors.5xx"].Parse()).To(Equal(float64(1)))
+			Expect(metrics.Gauges["http.healthy"].Parse()).To(Equal(float64(1)))
+			Expect(metrics.Gauges["goroutines"].Parse()).To(Equal(float64(27)))
+			Expect(metrics.Gauges["memstats.Alloc"].Parse()).To(Equal(float64(1048576)))
+			Expect(metrics.Gauges["memstats.GCCPUFraction"].Parse()).To(Equal(0.0012))
+			Expect(metrics.Gauges).NotTo(HaveKey("memstats.PauseNs"))
+			Expect(metrics.Gauges).NotTo(HaveKey("http.version"))
+		})
+
+		It("Should pick only configured memstats fields", func() {
+			metrics, err := NewExpvarInput(ExpvarConfig{MemStats: []string{"HeapInuse"}}).Fetch(services[0])
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metrics.Gauges).To(HaveKey("memstats.HeapInuse"))
+			Expect(metrics.Gauges).NotTo(HaveKey("memstats.Alloc"))
+		})
+
+		It("Should give up on services not responding in time", func() {
+			server.SetHandler(0, func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(500 * time.Millisecond)
+				w.Write([]byte(expvarJson))
+			})
+
+			started := time.Now()
+			_, err := NewExpvarInput(ExpvarConfig{Timeout: 50 * time.Millisecond}).Fetch(services[0])
+
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(started)).To(BeNumerically("<", 400*time.Millisecond))
+		})
+
+		It("Should be aggregated by the regular filters", func() {
+			grouped := GatherServiceMetrics(services, NewInputs(InputConfig{}, nil), 1)
+			filter := models.Filter{Group: "gauges", Path: "^goroutines$", Measurement: "go_runtime"}
+
+			Expect(grouped["sidecar"]).To(HaveLen(2))
+			Expect(filter.ParseSingle(grouped["sidecar"][0])).To(HaveLen(1))
+
+			result := filter.ParseMany("sidecar", grouped["sidecar"])
+			Expect(result).To(HaveLen(1))
+			Expect(result[0].Fields["sum"]).To(Equal(float64(54)))
+		})
+	})
+})
@@ -1,6 +1,9 @@
 package metrics
 
 import (
+	"net/http"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/Wikia/metrics-fetcher/models"
 	"github.com/go-errors/errors"
@@ -8,8 +11,135 @@ import (
 	pool "gopkg.in/go-playground/pool.v3"
 )
 
+// defaultInputTimeout limits time of a single request of the inputs
+const defaultInputTimeout = 30 * time.Second
+
+const (
+	// FormatDropwizard is the default input format - Dropwizard metrics servlet JSON
+	FormatDropwizard = "dropwizard"
+	// FormatSpringBoot is the Spring Boot Actuator (Micrometer) metrics endpoint
+	FormatSpringBoot = "spring_boot"
+	// FormatJolokia is the Jolokia JMX-HTTP bridge
+	FormatJolokia = "jolokia"
+	// FormatExpvar is the Go expvar endpoint
+	FormatExpvar = "expvar"
+)
+
+// Input fetches metrics of a single service instance and decodes them into the common metrics structure
+type Input interface {
+	Fetch(serviceInfo models.ServiceInfo) (models.PandoraMetrics, error)
+}
+
+// Inputs maps input format name (models.ServiceInfo.Format) to the Input handling it
+type Inputs map[string]Input
+
+// InputConfig holds configuration of all the input formats
+type InputConfig struct {
+	Dropwizard DropwizardConfig `mapstructure:"dropwizard"`
+	SpringBoot SpringBootConfig `mapstructure:"spring_boot"`
+	Jolokia    JolokiaConfig    `mapstructure:"jolokia"`
+	Expvar     ExpvarConfig     `mapstructure:"expvar"`
+}
+
+// NewInputs creates all the supported inputs using given configuration, filters are used by the inputs
+// that can skip metrics not matched by any of them
+func NewInputs(config InputConfig, filters models.Filters) Inputs {
+	return Inputs{
+		FormatDropwizard: NewDropwizardInput(config.Dropwizard, filters),
+		FormatSpringBoot: NewSpringBootInput(config.SpringBoot),
+		FormatJolokia:    NewJolokiaInput(config.Jolokia),
+		FormatExpvar:     NewExpvarInput(config.Expvar),
+	}
+}
+
+func (i Inputs) get(format string) (Input, error) {
+	if len(format) == 0 {
+		format = FormatDropwizard
+	}
+
+	if input, ok := i[format]; ok {
+		return input, nil
+	}
+
+	if format == FormatDropwizard {
+		return DropwizardInput{}, nil
+	}
+
+	return nil, errors.Errorf("Unknown metrics format: %s", format)
+}
+
+// DropwizardConfig holds configuration of the Dropwizard input
+type DropwizardConfig struct {
+	// Streaming enables decoding the response token by token, keeping only metrics matched by the filters
+	Streaming bool `mapstructure:"streaming"`
+	// MaxResponseSize limits the size (in bytes) of a streamed response, 0 means no limit
+	MaxResponseSize int64 `mapstructure:"max_response_size"`
+	// Timeout of a request, 30s by default
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// DropwizardInput reads metrics exposed by the Dropwizard metrics servlet
+type DropwizardInput struct {
+	config  DropwizardConfig
+	matcher keyMatcher
+	client  *http.Client
+}
+
+// NewDropwizardInput creates new instance of DropwizardInput
+func NewDropwizardInput(config DropwizardConfig, filters models.Filters) DropwizardInput {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultInputTimeout
+	}
+
+	input := DropwizardInput{config: config}
+	if config.Streaming {
+		input.matcher = newKeyMatcher(filters)
+		input.client = newHTTPClient(config.Timeout, nil)
+	}
+
+	return input
+}
+
+// Fetch returns metrics of a given service
+func (d DropwizardInput) Fetch(serviceInfo models.ServiceInfo) (models.PandoraMetrics, error) {
+	if d.config.Streaming {
+		return streamDropwizard(d.client, serviceInfo.GetAddress(), d.matcher, d.config.MaxResponseSize)
+	}
+
+	metrics := models.PandoraMetrics{}
+	err := fetchJSON(serviceInfo.GetAddress(), d.config.Timeout, &metrics)
+
+	return metrics, err
+}
+
+// fetchJSON calls given address and decodes JSON response into v, the request fails after timeout
+func fetchJSON(uri string, timeout time.Duration, v interface{}) error {
+	return endJSON(gorequest.New().Timeout(timeout).Get(uri), uri, v)
+}
+
+// postJSON sends JSON body to a given address and decodes JSON response into v, the request fails after timeout
+func postJSON(uri string, body string, timeout time.Duration, v interface{}) error {
+	return endJSON(gorequest.New().Timeout(timeout).Post(uri).Type("json").Send(body), uri, v)
+}
+
+func endJSON(request *gorequest.SuperAgent, uri string, v interface{}) error {
+	resp, _, err := request.EndStruct(v)
+
+	if len(err) != 0 {
+		log.WithFields(log.Fields{"uri": uri, "errors": err}).Error("Error fetching metrics")
+		return err[0]
+	}
+
+	if resp.StatusCode != 200 {
+		log.WithField("uri", uri).Error("Response status != 200")
+		return errors.Errorf("Got unexpected status from metrics endpoint: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
 // GatherServiceMetrics will fetch metrics for a given service
-func GatherServiceMetrics(services []models.ServiceInfo, maxWorkers uint) models.GroupedMetrics {
+func GatherServiceMetrics(services []models.ServiceInfo, inputs Inputs, maxWorkers uint) models.GroupedMetrics {
 	log.Infof("Starting metrics fetching: %d services", len(services))
 
 	log.Debugf("Starting workers for %d jobs", len(services))
@@ -21,7 +151,7 @@ func GatherServiceMetrics(services []models.ServiceInfo, maxWorkers uint) models
 	go func() {
 		for i, serviceInfo := range services {
 			log.Debugf("Queing service '%s' (%d)", serviceInfo.ID, i+1)
-			batch.Queue(getServiceMetrics(serviceInfo))
+			batch.Queue(getServiceMetrics(serviceInfo, inputs))
 		}
 		batch.QueueComplete()
 	}()
@@ -41,21 +171,21 @@ func GatherServiceMetrics(services []models.ServiceInfo, maxWorkers uint) models
 	return metrics
 }
 
-func getServiceMetrics(serviceInfo models.ServiceInfo) pool.WorkFunc {
+func getServiceMetrics(serviceInfo models.ServiceInfo, inputs Inputs) pool.WorkFunc {
 	return func(wu pool.WorkUnit) (interface{}, error) {
 		metric := models.SimpleMetrics{Service: serviceInfo}
 
-		log.WithFields(log.Fields{"task_id": metric.Service.ID, "uri": metric.Service.GetAddress()}).Info("Fetching metrics for service")
-		resp, _, err := gorequest.New().Get(metric.Service.GetAddress()).EndStruct(&metric.Metrics)
-
-		if len(err) != 0 {
-			log.WithFields(log.Fields{"task_id": metric.Service.ID, "uri": metric.Service.GetAddress(), "errors": err}).Error("Error fetching metrics")
-			return nil, err[0]
+		input, err := inputs.get(serviceInfo.Format)
+		if err != nil {
+			log.WithError(err).WithField("task_id", metric.Service.ID).Error("Cannot fetch metrics")
+			return nil, err
 		}
 
-		if resp.StatusCode != 200 {
-			log.WithFields(log.Fields{"task_id": metric.Service.ID, "uri": metric.Service.GetAddress()}).Error("Response status != 200")
-			return nil, errors.Errorf("Got unexpected status from metrics endpoint: %d", resp.StatusCode)
+		log.WithFields(log.Fields{"task_id": metric.Service.ID, "format": serviceInfo.Format}).Info("Fetching metrics for service")
+		metric.Metrics, err = input.Fetch(serviceInfo)
+		if err != nil {
+			log.WithError(err).WithField("task_id", metric.Service.ID).Error("Error fetching metrics")
+			return nil, err
 		}
 
 		return metric, nil
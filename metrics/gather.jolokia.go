@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+const defaultJolokiaPath = "/jolokia"
+
+// JolokiaConfig holds configuration of the Jolokia input
+type JolokiaConfig struct {
+	// MBeans lists MBeans (and their attributes) sent in a single bulk read request
+	MBeans []JolokiaMBean `mapstructure:"mbeans"`
+	// Timeout of a request, 30s by default
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// JolokiaMBean defines MBean attributes to read, all attributes are read when none are given
+type JolokiaMBean struct {
+	MBean      string   `mapstructure:"mbean" json:"mbean"`
+	Attributes []string `mapstructure:"attributes" json:"attribute,omitempty"`
+}
+
+// JolokiaInput reads JMX values through the Jolokia bulk read request.
+//
+// Every numeric value becomes a gauge named "<mbean>.<attribute>", values of composite attributes
+// are named by their dotted path, e.g. "java.lang:type=Memory.HeapMemoryUsage.used".
+type JolokiaInput struct {
+	request string
+	timeout time.Duration
+}
+
+type jolokiaRequest struct {
+	Type string `json:"type"`
+	JolokiaMBean
+}
+
+type jolokiaResponse struct {
+	Request struct {
+		MBean string `json:"mbean"`
+	} `json:"request"`
+	Value  json.RawMessage `json:"value"`
+	Status int             `json:"status"`
+	Error  string          `json:"error"`
+}
+
+// NewJolokiaInput creates new instance of JolokiaInput
+func NewJolokiaInput(config JolokiaConfig) JolokiaInput {
+	requests := make([]jolokiaRequest, len(config.MBeans))
+	for i, mbean := range config.MBeans {
+		requests[i] = jolokiaRequest{Type: "read", JolokiaMBean: mbean}
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultInputTimeout
+	}
+
+	body, _ := json.Marshal(requests)
+	return JolokiaInput{request: string(body), timeout: timeout}
+}
+
+// Fetch sends the bulk read request to a given service
+func (j JolokiaInput) Fetch(serviceInfo models.ServiceInfo) (models.PandoraMetrics, error) {
+	metrics := models.PandoraMetrics{Gauges: map[string]models.PandoraGauge{}}
+
+	responses := []jolokiaResponse{}
+	if err := postJSON(serviceInfo.GetURL(defaultJolokiaPath), j.request, j.timeout, &responses); err != nil {
+		return metrics, err
+	}
+
+	for _, response := range responses {
+		if response.Status != 200 {
+			log.WithFields(log.Fields{"task_id": serviceInfo.ID, "mbean": response.Request.MBean, "error": response.Error}).Warn("Error reading MBean - skipping")
+			continue
+		}
+
+		// pattern requests return values grouped by the full MBean name
+		prefix := response.Request.MBean
+		if strings.ContainsAny(prefix, "*?") {
+			prefix = ""
+		}
+
+		if err := flattenGauges(metrics.Gauges, prefix, response.Value); err != nil {
+			log.WithError(err).WithFields(log.Fields{"task_id": serviceInfo.ID, "mbean": response.Request.MBean}).Warn("Error decoding MBean value - skipping")
+		}
+	}
+
+	return metrics, nil
+}
+
+// flattenGauges decodes a nested JSON value and stores all its numeric leaves as gauges named by their dotted path
+func flattenGauges(gauges map[string]models.PandoraGauge, prefix string, raw json.RawMessage) error {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	flattenValue(gauges, prefix, value)
+	return nil
+}
+
+func flattenValue(gauges map[string]models.PandoraGauge, key string, value interface{}) {
+	switch v := value.(type) {
+	case json.Number:
+		gauges[key] = models.PandoraGauge{Value: []byte(v.String())}
+	case bool:
+		if v {
+			gauges[key] = models.PandoraGauge{Value: []byte("1")}
+		} else {
+			gauges[key] = models.PandoraGauge{Value: []byte("0")}
+		}
+	case map[string]interface{}:
+		for k, item := range v {
+			if len(key) == 0 {
+				flattenValue(gauges, k, item)
+			} else {
+				flattenValue(gauges, key+"."+k, item)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package metrics_test
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var jolokiaRequestJson = `[{"type":"read","mbean":"java.lang:type=Memory","attribute":["HeapMemoryUsage"]},{"type":"read","mbean":"java.lang:type=Threading","attribute":["ThreadCount","ObjectMonitorUsageSupported"]},{"type":"read","mbean":"java.lang:type=GarbageCollector,name=*","attribute":["CollectionCount"]},{"type":"read","mbean":"com.example:type=Missing"}]`
+var jolokiaResponseJson = `[
+{"request":{"mbean":"java.lang:type=Memory","attribute":["HeapMemoryUsage"],"type":"read"},"value":{"HeapMemoryUsage":{"init":268435456,"committed":257425408,"max":3817865216,"used":85063952}},"timestamp":1479293436,"status":200},
+{"request":{"mbean":"java.lang:type=Threading","attribute":["ThreadCount","ObjectMonitorUsageSupported"],"type":"read"},"value":{"ThreadCount":42,"ObjectMonitorUsageSupported":true},"timestamp":1479293436,"status":200},
+{"request":{"mbean":"java.lang:type=GarbageCollector,name=*","attribute":["CollectionCount"],"type":"read"},"value":{"java.lang:name=PS Scavenge,type=GarbageCollector":{"CollectionCount":12},"java.lang:name=PS MarkSweep,type=GarbageCollector":{"CollectionCount":3}},"timestamp":1479293436,"status":200},
+{"request":{"mbean":"com.example:type=Missing","type":"read"},"error_type":"javax.management.InstanceNotFoundException","error":"javax.management.InstanceNotFoundException : com.example:type=Missing","status":404}
+]`
+
+var _ = Describe("JolokiaInput", func() {
+	var server *ghttp.Server
+	var service models.ServiceInfo
+
+	config := JolokiaConfig{
+		MBeans: []JolokiaMBean{
+			{MBean: "java.lang:type=Memory", Attributes: []string{"HeapMemoryUsage"}},
+			{MBean: "java.lang:type=Threading", Attributes: []string{"ThreadCount", "ObjectMonitorUsageSupported"}},
+			{MBean: "java.lang:type=GarbageCollector,name=*", Attributes: []string{"CollectionCount"}},
+			{MBean: "com.example:type=Missing"},
+		},
+	}
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		serverHost, serverPort, _ := net.SplitHostPort(server.Addr())
+		serverPortInt, _ := strconv.ParseInt(serverPort, 10, 64)
+		service = models.ServiceInfo{
+			Name:   "legacy-service",
+			ID:     "1234",
+			Host:   serverHost,
+			Port:   serverPortInt,
+			Format: FormatJolokia,
+		}
+
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/jolokia"),
+				ghttp.VerifyJSON(jolokiaRequestJson),
+				ghttp.RespondWith(http.StatusOK, jolokiaResponseJson),
+			),
+		)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("Fetch()", func() {
+		It("Should map MBean attributes into gauges", func() {
+			metrics, err := NewJolokiaInput(config).Fetch(service)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+			Expect(metrics.Gauges).To(HaveLen(8))
+			Expect(metrics.Gauges["java.lang:type=Memory.HeapMemoryUsage.used"].Parse()).To(Equal(float64(85063952)))
+			Expect(metrics.Gauges["java.lang:type=Memory.HeapMemoryUsage.max"].Parse()).To(Equal(float64(3817865216)))
+			Expect(metrics.Gauges["java.lang:type=Threading.ThreadCount"].Parse()).To(Equal(float64(42)))
+			Expect(metrics.Gauges["java.lang:type=Threading.ObjectMonitorUsageSupported"].Parse()).To(Equal(float64(1)))
+			Expect(metrics.Gauges["java.lang:name=PS Scavenge,type=GarbageCollector.CollectionCount"].Parse()).To(Equal(float64(12)))
+			Expect(metrics.Gauges["java.lang:name=PS MarkSweep,type=GarbageCollector.CollectionCount"].Parse()).To(Equal(float64(3)))
+		})
+
+		It("Should be selectable by the regular filters", func() {
+			grouped := GatherServiceMetrics([]models.ServiceInfo{service}, NewInputs(InputConfig{Jolokia: config}, nil), 1)
+			filter := models.Filter{Group: "gauges", Path: "GarbageCollector\\.CollectionCount$", Measurement: "jvm_gc"}
+
+			result := filter.ParseMany("legacy-service", grouped["legacy-service"])
+			Expect(result).To(HaveLen(2))
+			Expect(result[0].Fields["count"]).To(Equal(1))
+		})
+	})
+})
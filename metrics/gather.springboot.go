@@ -0,0 +1,159 @@
+package metrics
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+)
+
+const (
+	defaultSpringBootPath     = "/actuator/metrics"
+	defaultSpringBootMaxNames = 500
+
+	springStatisticValue     = "VALUE"
+	springStatisticCount     = "COUNT"
+	springStatisticTotalTime = "TOTAL_TIME"
+)
+
+// SpringBootConfig holds configuration of the Spring Boot Actuator input
+type SpringBootConfig struct {
+	// MaxNames limits how many metric names are crawled per service instance
+	MaxNames int `mapstructure:"max_names"`
+	// ExpandTags lists tags for which every available value is fetched as a separate metric
+	ExpandTags []string `mapstructure:"expand_tags"`
+	// Timeout of a single request, 30s by default
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// SpringBootInput reads metrics exposed by the Spring Boot Actuator metrics endpoint.
+//
+// Every measurement becomes a gauge: VALUE under the metric name, other statistics under
+// "<name>.<statistic>" (lowercase). Metrics having both COUNT and TOTAL_TIME are also exposed as timers
+// and metrics having only COUNT as meters, so the same filters work as for Dropwizard services. Actuator exposes no
+// rates or percentiles, so the timers and meters carry only the count (TOTAL_TIME and MAX are available as gauges).
+type SpringBootInput struct {
+	config SpringBootConfig
+}
+
+type springBootNames struct {
+	Names []string `json:"names"`
+}
+
+type springBootMeasurement struct {
+	Statistic string  `json:"statistic"`
+	Value     float64 `json:"value"`
+}
+
+type springBootTag struct {
+	Tag    string   `json:"tag"`
+	Values []string `json:"values"`
+}
+
+type springBootMetric struct {
+	Name          string                  `json:"name"`
+	Measurements  []springBootMeasurement `json:"measurements"`
+	AvailableTags []springBootTag         `json:"availableTags"`
+}
+
+// NewSpringBootInput creates new instance of SpringBootInput
+func NewSpringBootInput(config SpringBootConfig) SpringBootInput {
+	if config.MaxNames <= 0 {
+		config.MaxNames = defaultSpringBootMaxNames
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultInputTimeout
+	}
+
+	return SpringBootInput{config: config}
+}
+
+// Fetch crawls the list of metric names and fetches details of each of them
+func (s SpringBootInput) Fetch(serviceInfo models.ServiceInfo) (models.PandoraMetrics, error) {
+	metrics := models.PandoraMetrics{
+		Gauges: map[string]models.PandoraGauge{},
+		Meters: map[string]models.PandoraMeter{},
+		Timers: map[string]models.PandoraTimer{},
+	}
+
+	address := serviceInfo.GetURL(defaultSpringBootPath)
+	names := springBootNames{}
+	if err := fetchJSON(address, s.config.Timeout, &names); err != nil {
+		return metrics, err
+	}
+
+	if len(names.Names) > s.config.MaxNames {
+		log.WithFields(log.Fields{"task_id": serviceInfo.ID, "names": len(names.Names), "max_names": s.config.MaxNames}).Warn("Too many metric names - truncating")
+		names.Names = names.Names[:s.config.MaxNames]
+	}
+
+	for _, name := range names.Names {
+		detail := springBootMetric{}
+		if err := fetchJSON(address+"/"+escapePathSegment(name), s.config.Timeout, &detail); err != nil {
+			log.WithError(err).WithFields(log.Fields{"task_id": serviceInfo.ID, "metric": name}).Warn("Error fetching metric details - skipping")
+			continue
+		}
+		s.addMeasurements(metrics, name, detail.Measurements)
+
+		for _, tag := range detail.AvailableTags {
+			if !s.expands(tag.Tag) {
+				continue
+			}
+
+			for _, value := range tag.Values {
+				tagged := springBootMetric{}
+				query := url.Values{"tag": []string{tag.Tag + ":" + value}}
+				if err := fetchJSON(address+"/"+escapePathSegment(name)+"?"+query.Encode(), s.config.Timeout, &tagged); err != nil {
+					log.WithError(err).WithFields(log.Fields{"task_id": serviceInfo.ID, "metric": name, "tag": tag.Tag}).Warn("Error fetching metric details - skipping")
+					continue
+				}
+				s.addMeasurements(metrics, strings.Join([]string{name, tag.Tag, value}, "."), tagged.Measurements)
+			}
+		}
+	}
+
+	return metrics, nil
+}
+
+// escapePathSegment escapes a value used as a single segment of a URL path, slashes included
+func escapePathSegment(value string) string {
+	return strings.Replace((&url.URL{Path: value}).EscapedPath(), "/", "%2F", -1)
+}
+
+func (s SpringBootInput) expands(tag string) bool {
+	for _, t := range s.config.ExpandTags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s SpringBootInput) addMeasurements(metrics models.PandoraMetrics, name string, measurements []springBootMeasurement) {
+	statistics := map[string]float64{}
+	for _, measurement := range measurements {
+		statistics[measurement.Statistic] = measurement.Value
+
+		key := name
+		if measurement.Statistic != springStatisticValue {
+			key = name + "." + strings.ToLower(measurement.Statistic)
+		}
+		metrics.Gauges[key] = models.PandoraGauge{Value: []byte(strconv.FormatFloat(measurement.Value, 'g', -1, 64))}
+	}
+
+	count, hasCount := statistics[springStatisticCount]
+	if !hasCount {
+		return
+	}
+
+	if _, hasTotal := statistics[springStatisticTotalTime]; hasTotal {
+		metrics.Timers[name] = models.PandoraTimer{Count: uint64(count), CountOnly: true}
+		return
+	}
+
+	metrics.Meters[name] = models.PandoraMeter{Count: uint64(count), CountOnly: true}
+}
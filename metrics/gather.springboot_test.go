@@ -0,0 +1,126 @@
+package metrics_test
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var springBootNamesJson = `{"names":["jvm.memory.used","http.server.requests","logback.events"]}`
+var springBootMemoryJson = `{"name":"jvm.memory.used","baseUnit":"bytes","measurements":[{"statistic":"VALUE","value":1.2345E8}],"availableTags":[{"tag":"area","values":["heap","nonheap"]}]}`
+var springBootMemoryHeapJson = `{"name":"jvm.memory.used","baseUnit":"bytes","measurements":[{"statistic":"VALUE","value":1.0E8}],"availableTags":[]}`
+var springBootMemoryNonHeapJson = `{"name":"jvm.memory.used","baseUnit":"bytes","measurements":[{"statistic":"VALUE","value":2.345E7}],"availableTags":[]}`
+var springBootRequestsJson = `{"name":"http.server.requests","baseUnit":"seconds","measurements":[{"statistic":"COUNT","value":42.0},{"statistic":"TOTAL_TIME","value":1.5},{"statistic":"MAX","value":0.25}],"availableTags":[{"tag":"uri","values":["/health"]}]}`
+var springBootEventsJson = `{"name":"logback.events","measurements":[{"statistic":"COUNT","value":7.0}],"availableTags":[]}`
+
+var _ = Describe("SpringBootInput", func() {
+	var server *ghttp.Server
+	var service models.ServiceInfo
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		serverHost, serverPort, _ := net.SplitHostPort(server.Addr())
+		serverPortInt, _ := strconv.ParseInt(serverPort, 10, 64)
+		service = models.ServiceInfo{
+			Name:   "spring-service",
+			ID:     "1234",
+			Host:   serverHost,
+			Port:   serverPortInt,
+			Format: FormatSpringBoot,
+		}
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("Fetch()", func() {
+		Context("With all names below the cap", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/actuator/metrics"),
+						ghttp.RespondWith(http.StatusOK, springBootNamesJson),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/actuator/metrics/jvm.memory.used"),
+						ghttp.RespondWith(http.StatusOK, springBootMemoryJson),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/actuator/metrics/jvm.memory.used", "tag=area%3Aheap"),
+						ghttp.RespondWith(http.StatusOK, springBootMemoryHeapJson),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/actuator/metrics/jvm.memory.used", "tag=area%3Anonheap"),
+						ghttp.RespondWith(http.StatusOK, springBootMemoryNonHeapJson),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/actuator/metrics/http.server.requests"),
+						ghttp.RespondWith(http.StatusOK, springBootRequestsJson),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/actuator/metrics/logback.events"),
+						ghttp.RespondWith(http.StatusOK, springBootEventsJson),
+					),
+				)
+			})
+
+			It("Should map measurements to gauges, timers and meters", func() {
+				input := NewSpringBootInput(SpringBootConfig{ExpandTags: []string{"area"}})
+				metrics, err := input.Fetch(service)
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(server.ReceivedRequests()).To(HaveLen(6))
+
+				Expect(metrics.Gauges).To(HaveLen(7))
+				Expect(metrics.Gauges["jvm.memory.used"].Parse()).To(Equal(1.2345e8))
+				Expect(metrics.Gauges["jvm.memory.used.area.heap"].Parse()).To(Equal(1.0e8))
+				Expect(metrics.Gauges["jvm.memory.used.area.nonheap"].Parse()).To(Equal(2.345e7))
+				Expect(metrics.Gauges["http.server.requests.count"].Parse()).To(Equal(42.0))
+				Expect(metrics.Gauges["http.server.requests.total_time"].Parse()).To(Equal(1.5))
+				Expect(metrics.Gauges["http.server.requests.max"].Parse()).To(Equal(0.25))
+				Expect(metrics.Gauges["logback.events.count"].Parse()).To(Equal(7.0))
+
+				Expect(metrics.Timers).To(Equal(map[string]models.PandoraTimer{"http.server.requests": {Count: 42, CountOnly: true}}))
+				Expect(metrics.Meters).To(Equal(map[string]models.PandoraMeter{"logback.events": {Count: 7, CountOnly: true}}))
+			})
+
+			It("Should feed the regular filters", func() {
+				grouped := GatherServiceMetrics([]models.ServiceInfo{service}, NewInputs(InputConfig{SpringBoot: SpringBootConfig{ExpandTags: []string{"area"}}}, nil), 1)
+				filter := models.Filter{Group: "timers", Path: "^http\\.server\\.requests$", Measurement: "http"}
+
+				result := filter.ParseSingle(grouped["spring-service"][0])
+				Expect(result).To(HaveLen(1))
+				Expect(result[0].Fields["value"]).To(Equal(uint64(42)))
+			})
+		})
+
+		Context("With more names than the cap", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.RespondWith(http.StatusOK, springBootNamesJson),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/actuator/metrics/jvm.memory.used"),
+						ghttp.RespondWith(http.StatusOK, springBootMemoryJson),
+					),
+				)
+			})
+
+			It("Should crawl only the first names", func() {
+				input := NewSpringBootInput(SpringBootConfig{MaxNames: 1})
+				metrics, err := input.Fetch(service)
+
+				Expect(err).NotTo(HaveOccurred())
+				Expect(server.ReceivedRequests()).To(HaveLen(2))
+				Expect(metrics.Gauges).To(HaveLen(1))
+				Expect(metrics.Gauges).To(HaveKey("jvm.memory.used"))
+			})
+		})
+	})
+})
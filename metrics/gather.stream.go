@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+const (
+	groupGauges = "gauges"
+	groupMeters = "meters"
+	groupTimers = "timers"
+)
+
+// ErrResponseTooLarge is returned when the metrics response exceeds the configured size
+var ErrResponseTooLarge = errors.New("metrics response too large")
+
+// keyMatcher holds compiled filters by metric group
+type keyMatcher map[string]models.Filters
+
+func newKeyMatcher(filters models.Filters) keyMatcher {
+	matcher := keyMatcher{}
+	for _, filter := range filters {
+		matcher[filter.Group] = append(matcher[filter.Group], filter)
+	}
+
+	return matcher
+}
+
+func (m keyMatcher) match(group string, key string) bool {
+	for _, filter := range m[group] {
+		if filter.Matches(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skipValue consumes a JSON value without decoding it
+type skipValue struct{}
+
+func (skipValue) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+// sizeLimitedReader fails with ErrResponseTooLarge once more than limit bytes are read
+type sizeLimitedReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+}
+
+func (r *sizeLimitedReader) Read(p []byte) (int, error) {
+	if r.read > r.limit {
+		return 0, ErrResponseTooLarge
+	}
+
+	// never hand out more than one byte above the limit, so the decoder cannot finish an oversized document
+	if remaining := r.limit - r.read + 1; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return 0, ErrResponseTooLarge
+	}
+
+	return n, err
+}
+
+func streamDropwizard(client *http.Client, uri string, matcher keyMatcher, maxSize int64) (models.PandoraMetrics, error) {
+	resp, err := client.Get(uri)
+	if err != nil {
+		log.WithError(err).WithField("uri", uri).Error("Error fetching metrics")
+		return models.PandoraMetrics{}, errors.Wrap(err, 0)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		log.WithField("uri", uri).Error("Response status != 200")
+		return models.PandoraMetrics{}, errors.Errorf("Got unexpected status from metrics endpoint: %d", resp.StatusCode)
+	}
+
+	metrics, err := decodeDropwizard(resp.Body, matcher, maxSize)
+	if err != nil {
+		log.WithError(err).WithField("uri", uri).Error("Error decoding metrics")
+	}
+
+	return metrics, err
+}
+
+// decodeDropwizard reads Dropwizard metrics JSON token by token keeping only metrics matched by the matcher
+func decodeDropwizard(reader io.Reader, matcher keyMatcher, maxSize int64) (models.PandoraMetrics, error) {
+	metrics := models.PandoraMetrics{
+		Gauges: map[string]models.PandoraGauge{},
+		Meters: map[string]models.PandoraMeter{},
+		Timers: map[string]models.PandoraTimer{},
+	}
+
+	if maxSize > 0 {
+		reader = &sizeLimitedReader{reader: reader, limit: maxSize}
+	}
+	decoder := json.NewDecoder(reader)
+
+	err := decodeObject(decoder, func(group string) error {
+		switch group {
+		case groupGauges:
+			return decodeObject(decoder, func(key string) error {
+				if !matcher.match(group, key) {
+					return decoder.Decode(&skipValue{})
+				}
+				gauge := models.PandoraGauge{}
+				err := decoder.Decode(&gauge)
+				metrics.Gauges[key] = gauge
+				return err
+			})
+		case groupMeters:
+			return decodeObject(decoder, func(key string) error {
+				if !matcher.match(group, key) {
+					return decoder.Decode(&skipValue{})
+				}
+				meter := models.PandoraMeter{}
+				err := decoder.Decode(&meter)
+				metrics.Meters[key] = meter
+				return err
+			})
+		case groupTimers:
+			return decodeObject(decoder, func(key string) error {
+				if !matcher.match(group, key) {
+					return decoder.Decode(&skipValue{})
+				}
+				timer := models.PandoraTimer{}
+				err := decoder.Decode(&timer)
+				metrics.Timers[key] = timer
+				return err
+			})
+		default:
+			return decoder.Decode(&skipValue{})
+		}
+	})
+
+	if err != nil {
+		if err == ErrResponseTooLarge {
+			return metrics, err
+		}
+		return metrics, errors.Wrap(err, 0)
+	}
+
+	return metrics, nil
+}
+
+// decodeObject iterates over keys of a JSON object, value of each key has to be consumed by the callback
+func decodeObject(decoder *json.Decoder, value func(key string) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return errors.Errorf("Expected JSON object, got: %v", token)
+	}
+
+	for decoder.More() {
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		if err = value(token.(string)); err != nil {
+			return err
+		}
+	}
+
+	_, err = decoder.Token()
+	return err
+}
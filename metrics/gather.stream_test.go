@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/stretchr/testify/assert"
+)
+
+var streamFixture = []byte(`{"version":"3.0.0","gauges":{"jvm.threads.count":{"value":42},"jvm.memory.heap.used":{"value":1.5E8},"jvm.threads.daemon.count":{"value":7}},"counters":{"active-dispatches":{"count":0}},"histograms":{},"meters":{"ch.qos.logback.core.Appender.all":{"count":5834,"m1_rate":0.5,"units":"events/second"},"ch.qos.logback.core.Appender.debug":{"count":12,"m1_rate":0.1}},"timers":{"com.wikia.HelloWorldResource.getHelloWorld":{"count":3,"p50":0.0012,"p99":0.025,"m1_rate":1.5,"rate_units":"calls/second"},"com.wikia.HelloWorldResource.other":{"count":1,"p50":1.0,"p99":2.0}}}`)
+
+var streamFilters = []models.Filter{
+	{Group: "gauges", Path: "^jvm\\.threads\\.count$"},
+	{Group: "meters", Path: "Appender\\.all$"},
+	{Group: "timers", Path: "getHelloWorld"},
+}
+
+func TestDecodeDropwizardKeepsOnlyMatchedMetrics(t *testing.T) {
+	//when
+	metrics, err := decodeDropwizard(bytes.NewReader(streamFixture), newKeyMatcher(streamFilters), 0)
+
+	//then
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]models.PandoraGauge{"jvm.threads.count": {Value: []byte("42")}}, metrics.Gauges)
+	assert.Equal(t, map[string]models.PandoraMeter{"ch.qos.logback.core.Appender.all": {Count: 5834, M1Rate: 0.5}}, metrics.Meters)
+	assert.Equal(t, map[string]models.PandoraTimer{"com.wikia.HelloWorldResource.getHelloWorld": {Count: 3, P50: 0.0012, P99: 0.025, M1Rate: 1.5}}, metrics.Timers)
+}
+
+func TestDecodeDropwizardMatchesBufferedDecoding(t *testing.T) {
+	//given
+	filters := []models.Filter{
+		{Group: "gauges", Path: ".*"},
+		{Group: "meters", Path: ".*"},
+		{Group: "timers", Path: ".*"},
+	}
+	expected := models.PandoraMetrics{}
+	json.Unmarshal(streamFixture, &expected)
+
+	//when
+	metrics, err := decodeDropwizard(bytes.NewReader(streamFixture), newKeyMatcher(filters), 0)
+
+	//then
+	assert.Nil(t, err)
+	assert.Equal(t, expected, metrics)
+}
+
+func TestDecodeDropwizardEnforcesMaxSize(t *testing.T) {
+	//when
+	_, err := decodeDropwizard(bytes.NewReader(streamFixture), newKeyMatcher(streamFilters), 100)
+
+	//then
+	assert.Equal(t, ErrResponseTooLarge, err)
+}
+
+func TestDecodeDropwizardFailsOnInvalidJSON(t *testing.T) {
+	//when
+	_, err := decodeDropwizard(bytes.NewReader([]byte(`{"gauges":[1,2]}`)), newKeyMatcher(streamFilters), 0)
+
+	//then
+	assert.NotNil(t, err)
+}
+
+func TestStreamingDropwizardInputFetch(t *testing.T) {
+	//given
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/metrics", r.URL.Path)
+		w.Write(streamFixture)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portInt, _ := strconv.ParseInt(port, 10, 64)
+	input := NewDropwizardInput(DropwizardConfig{Streaming: true, MaxResponseSize: 1 << 20}, streamFilters)
+
+	//when
+	metrics, err := input.Fetch(models.ServiceInfo{Host: host, Port: portInt})
+
+	//then
+	assert.Nil(t, err)
+	assert.Len(t, metrics.Gauges, 1)
+	assert.Len(t, metrics.Meters, 1)
+	assert.Len(t, metrics.Timers, 1)
+}
+
+func TestStreamingDropwizardInputTimesOut(t *testing.T) {
+	//given
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portInt, _ := strconv.ParseInt(port, 10, 64)
+	input := NewDropwizardInput(DropwizardConfig{Streaming: true, Timeout: 50 * time.Millisecond}, streamFilters)
+
+	//when
+	_, err := input.Fetch(models.ServiceInfo{Host: host, Port: portInt})
+
+	//then
+	assert.NotNil(t, err)
+}
+
+// largeStreamFixture builds a payload with thousands of metrics of which only a few are matched by streamFilters
+func largeStreamFixture() []byte {
+	gauges := map[string]interface{}{"jvm.threads.count": map[string]interface{}{"value": 42}}
+	meters := map[string]interface{}{}
+	timers := map[string]interface{}{}
+	for i := 0; i < 5000; i++ {
+		gauges[fmt.Sprintf("io.dropwizard.jetty.endpoint%d.percent-4xx-1m", i)] = map[string]interface{}{"value": float64(i) / 3}
+		meters[fmt.Sprintf("io.dropwizard.jetty.endpoint%d.requests", i)] = map[string]interface{}{"count": i, "m1_rate": 0.5, "m5_rate": 0.4, "m15_rate": 0.3, "mean_rate": 0.2, "units": "events/second"}
+		timers[fmt.Sprintf("com.wikia.Resource.endpoint%d", i)] = map[string]interface{}{"count": i, "max": 0.5, "mean": 0.1, "min": 0.01, "p50": 0.1, "p75": 0.2, "p95": 0.3, "p98": 0.4, "p99": 0.45, "p999": 0.5, "stddev": 0.01, "m1_rate": 1.5, "duration_units": "seconds", "rate_units": "calls/second"}
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"version": "3.0.0", "gauges": gauges, "meters": meters, "timers": timers})
+	return payload
+}
+
+func BenchmarkDecodeDropwizardBuffered(b *testing.B) {
+	payload := largeStreamFixture()
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		metrics := models.PandoraMetrics{}
+		if err := json.Unmarshal(payload, &metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeDropwizardStreaming(b *testing.B) {
+	payload := largeStreamFixture()
+	matcher := newKeyMatcher(streamFilters)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeDropwizard(bytes.NewReader(payload), matcher, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
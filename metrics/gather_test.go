@@ -52,7 +52,7 @@ var _ = Describe("Gather", func() {
 					},
 				}
 
-				metrics := GatherServiceMetrics(services, 5)
+				metrics := GatherServiceMetrics(services, nil, 5)
 
 				Expect(metrics).To(HaveKey("test-service"))
 				Expect(metrics["test-service"]).To(HaveLen(1))
@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+)
+
+// Limits of the number of series sent in a single run, zero means no limit
+type Limits struct {
+	// MaxSeries limits series of the whole run
+	MaxSeries int `mapstructure:"max_series"`
+	// MaxSeriesPerService limits series of every service (by service_name tag)
+	MaxSeriesPerService int `mapstructure:"max_series_per_service"`
+}
+
+// SeriesSummary reports number of series of a run and series dropped over the limits
+type SeriesSummary struct {
+	Series           int
+	DroppedByFilter  map[string]int
+	DroppedByService map[string]int
+	// Dropped is the number of series dropped over the limit of the whole run
+	Dropped int
+}
+
+// Log writes the summary to the log, warning about dropped series
+func (s SeriesSummary) Log() {
+	entry := log.WithField("series", s.Series)
+	dropped := s.Dropped
+	for path, count := range s.DroppedByFilter {
+		entry.WithFields(log.Fields{"path": path, "dropped": count}).Warn("Series dropped over the filter limit")
+		dropped += count
+	}
+	for service, count := range s.DroppedByService {
+		entry.WithFields(log.Fields{"service_name": service, "dropped": count}).Warn("Series dropped over the service limit")
+		dropped += count
+	}
+	if s.Dropped != 0 {
+		entry.WithField("dropped", s.Dropped).Warn("Series dropped over the run limit")
+	}
+
+	entry.WithField("dropped", dropped).Info("Run summary")
+}
+
+// LimitSeries drops series over the per service and per run limits
+func LimitSeries(filteredMetrics []models.FilteredMetrics, limits Limits) ([]models.FilteredMetrics, SeriesSummary) {
+	summary := SeriesSummary{DroppedByService: map[string]int{}}
+
+	if limits.MaxSeriesPerService > 0 {
+		byService := map[string][]models.FilteredMetrics{}
+		for _, metric := range filteredMetrics {
+			if service, ok := metric.Tags["service_name"]; ok {
+				byService[service] = append(byService[service], metric)
+			}
+		}
+
+		dropped := map[string]bool{}
+		for service, metrics := range byService {
+			kept, count := models.LimitSeries(metrics, limits.MaxSeriesPerService)
+			if count == 0 {
+				continue
+			}
+			summary.DroppedByService[service] = count
+
+			keptIDs := map[string]bool{}
+			for _, metric := range kept {
+				keptIDs[models.SeriesID(metric)] = true
+			}
+			for _, metric := range metrics {
+				if id := models.SeriesID(metric); !keptIDs[id] {
+					dropped[id] = true
+				}
+			}
+		}
+
+		if len(dropped) != 0 {
+			result := []models.FilteredMetrics{}
+			for _, metric := range filteredMetrics {
+				if !dropped[models.SeriesID(metric)] {
+					result = append(result, metric)
+				}
+			}
+			filteredMetrics = result
+		}
+	}
+
+	filteredMetrics, summary.Dropped = models.LimitSeries(filteredMetrics, limits.MaxSeries)
+	summary.Series = countSeries(filteredMetrics)
+
+	return filteredMetrics, summary
+}
+
+func countSeries(filteredMetrics []models.FilteredMetrics) int {
+	series := map[string]bool{}
+	for _, metric := range filteredMetrics {
+		series[models.SeriesID(metric)] = true
+	}
+
+	return len(series)
+}
+
+// cardinalityGroup holds series of a measurement with the same tag keys
+type cardinalityGroup struct {
+	measurement string
+	tagKeys     string
+	series      map[string]bool
+}
+
+// cardinalityGroups sorts the groups by the number of series (the largest first), measurement and tag keys
+type cardinalityGroups []*cardinalityGroup
+
+func (g cardinalityGroups) Len() int      { return len(g) }
+func (g cardinalityGroups) Swap(i, j int) { g[i], g[j] = g[j], g[i] }
+func (g cardinalityGroups) Less(i, j int) bool {
+	if len(g[i].series) != len(g[j].series) {
+		return len(g[i].series) > len(g[j].series)
+	}
+	if g[i].measurement != g[j].measurement {
+		return g[i].measurement < g[j].measurement
+	}
+	return g[i].tagKeys < g[j].tagKeys
+}
+
+// ReportCardinality writes number of series grouped by measurement and tag keys, the largest groups first
+func ReportCardinality(filteredMetrics []models.FilteredMetrics, writer io.Writer) error {
+	groups := map[string]*cardinalityGroup{}
+	for _, metric := range filteredMetrics {
+		keys := make([]string, 0, len(metric.Tags))
+		for k := range metric.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		tagKeys := strings.Join(keys, ",")
+
+		id := metric.Measurement + " " + tagKeys
+		if groups[id] == nil {
+			groups[id] = &cardinalityGroup{measurement: metric.Measurement, tagKeys: tagKeys, series: map[string]bool{}}
+		}
+		groups[id].series[models.SeriesID(metric)] = true
+	}
+
+	sorted := make(cardinalityGroups, 0, len(groups))
+	total := 0
+	for _, g := range groups {
+		sorted = append(sorted, g)
+		total += len(g.series)
+	}
+	sort.Sort(sorted)
+
+	if _, err := fmt.Fprintf(writer, "%8s  %s  %s\n", "SERIES", "MEASUREMENT", "TAG KEYS"); err != nil {
+		return err
+	}
+	for _, g := range sorted {
+		if _, err := fmt.Fprintf(writer, "%8d  %s  %s\n", len(g.series), g.measurement, g.tagKeys); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(writer, "%8d  total\n", total)
+
+	return err
+}
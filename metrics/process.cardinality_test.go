@@ -0,0 +1,70 @@
+package metrics_test
+
+import (
+	"bytes"
+	"fmt"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cardinality", func() {
+	filtered := []models.FilteredMetrics{}
+	for i := 0; i < 6; i++ {
+		filtered = append(filtered, models.FilteredMetrics{
+			Measurement: "http_resources",
+			Tags:        map[string]string{"service_name": fmt.Sprintf("service-%d", i%2), "metric_name": fmt.Sprint(i)},
+			Fields:      map[string]interface{}{"value": i},
+		})
+	}
+	filtered = append(filtered, models.FilteredMetrics{
+		Measurement: "fleet",
+		Tags:        map[string]string{"metric_name": "all"},
+		Fields:      map[string]interface{}{"value": 1},
+	})
+
+	Describe("LimitSeries()", func() {
+		It("Should keep all the series without limits", func() {
+			result, summary := LimitSeries(filtered, Limits{})
+
+			Expect(result).To(Equal(filtered))
+			Expect(summary.Series).To(Equal(7))
+			Expect(summary.Dropped).To(Equal(0))
+			Expect(summary.DroppedByService).To(BeEmpty())
+		})
+
+		It("Should drop series over the service limit", func() {
+			result, summary := LimitSeries(filtered, Limits{MaxSeriesPerService: 2})
+
+			Expect(result).To(HaveLen(5))
+			Expect(summary.Series).To(Equal(5))
+			Expect(summary.DroppedByService).To(Equal(map[string]int{"service-0": 1, "service-1": 1}))
+			Expect(result[4].Measurement).To(Equal("fleet"))
+		})
+
+		It("Should drop series over the run limit", func() {
+			result, summary := LimitSeries(filtered, Limits{MaxSeries: 3, MaxSeriesPerService: 2})
+
+			Expect(result).To(HaveLen(3))
+			Expect(summary.Dropped).To(Equal(2))
+			Expect(summary.Series).To(Equal(3))
+		})
+	})
+
+	Describe("ReportCardinality()", func() {
+		It("Should count series by measurement and tag keys", func() {
+			var buf bytes.Buffer
+
+			Expect(ReportCardinality(append(filtered, filtered[0]), &buf)).To(Succeed())
+
+			Expect(buf.String()).To(Equal("" +
+				"  SERIES  MEASUREMENT  TAG KEYS\n" +
+				"       6  http_resources  metric_name,service_name\n" +
+				"       1  fleet  metric_name\n" +
+				"       7  total\n"))
+		})
+	})
+})
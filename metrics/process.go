@@ -4,19 +4,20 @@ import "github.com/Wikia/metrics-fetcher/models"
 
 // Combine metrics and filter them according to current configuration
 func Combine(serviceMetrics models.GroupedMetrics, filters []models.Filter) ([]models.FilteredMetrics, error) {
-	result := []models.FilteredMetrics{}
+	compiled, err := models.NewFilters(filters)
+	if err != nil {
+		return nil, err
+	}
 
-	for serviceName, metrics := range serviceMetrics {
-		for _, filter := range filters {
-			for _, metric := range metrics {
-				filteredMetrics := filter.ParseSingle(metric)
-				result = append(result, filteredMetrics...)
-			}
+	return compiled.CombineAll(serviceMetrics), nil
+}
 
-			combinedMetrics := filter.ParseMany(serviceName, metrics)
-			result = append(result, combinedMetrics...)
-		}
+// Derive evaluates derived metrics definitions over filtered metrics, derived metrics are appended to the result
+func Derive(filteredMetrics []models.FilteredMetrics, derived []models.Derived) ([]models.FilteredMetrics, error) {
+	compiled, err := models.NewDerivedMetrics(derived)
+	if err != nil {
+		return filteredMetrics, err
 	}
 
-	return result, nil
+	return append(filteredMetrics, compiled.Apply(filteredMetrics)...), nil
 }
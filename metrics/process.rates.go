@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+// DefaultRatesMaxAge is the age after which samples of series which are no longer reported are forgotten
+const DefaultRatesMaxAge = time.Hour
+
+// CounterSample is the previous value of a counter
+type CounterSample struct {
+	TaskID    string    `json:"task_id"`
+	Value     uint64    `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Rates keeps previous samples of meter and timer counts to compute their per second rates across runs.
+//
+// Series are identified by service name, host and port of the instance and metric key. A counter is considered reset
+// when the task ID of the series changes (a restarted task) or its value decreases, the first sample after a reset
+// produces no rate.
+type Rates struct {
+	Samples map[string]CounterSample `json:"samples"`
+	// MaxAge is the age of samples which are dropped
+	MaxAge time.Duration `json:"-"`
+
+	matcher keyMatcher
+}
+
+// NewRates creates empty rates state, only counters matched by the filters are tracked
+func NewRates(filters models.Filters) *Rates {
+	return &Rates{
+		Samples: map[string]CounterSample{},
+		MaxAge:  DefaultRatesMaxAge,
+		matcher: newKeyMatcher(filters),
+	}
+}
+
+// LoadRates reads rates state saved by a previous run, missing file results in an empty state
+func LoadRates(path string, filters models.Filters) (*Rates, error) {
+	rates := NewRates(filters)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rates, nil
+	}
+	if err != nil {
+		return rates, errors.Wrap(err, 0)
+	}
+
+	if err = json.Unmarshal(data, rates); err != nil {
+		return NewRates(filters), errors.WrapPrefix(err, "Invalid rates state file: "+path, 0)
+	}
+	if rates.Samples == nil {
+		rates.Samples = map[string]CounterSample{}
+	}
+
+	return rates, nil
+}
+
+// Save writes rates state to a file, the file is replaced atomically
+func (r *Rates) Save(path string) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, 0)
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
+
+// Apply sets rates of meters and timers of all the instances and stores their counts for the next run
+func (r *Rates) Apply(serviceMetrics models.GroupedMetrics, now time.Time) {
+	for serviceName, metrics := range serviceMetrics {
+		for _, metric := range metrics {
+			// tasks of a service can share a host, series are kept per address so a restarted task replaces its sample
+			prefix := serviceName + "|" + metric.Service.Host + ":" + strconv.FormatInt(metric.Service.Port, 10)
+
+			for k, meter := range metric.Metrics.Meters {
+				if !r.matcher.match(groupMeters, k) {
+					continue
+				}
+				meter.Rate = r.rate(prefix+"|"+groupMeters+"|"+k, metric.Service.ID, meter.Count, now)
+				metric.Metrics.Meters[k] = meter
+			}
+
+			for k, timer := range metric.Metrics.Timers {
+				if !r.matcher.match(groupTimers, k) {
+					continue
+				}
+				timer.Rate = r.rate(prefix+"|"+groupTimers+"|"+k, metric.Service.ID, timer.Count, now)
+				metric.Metrics.Timers[k] = timer
+			}
+		}
+	}
+
+	for series, sample := range r.Samples {
+		if r.MaxAge > 0 && now.Sub(sample.Timestamp) > r.MaxAge {
+			delete(r.Samples, series)
+		}
+	}
+}
+
+// rate returns per second rate of the counter since its previous sample, nil for the first sample and resets
+func (r *Rates) rate(series string, taskID string, value uint64, now time.Time) *float64 {
+	previous, ok := r.Samples[series]
+	r.Samples[series] = CounterSample{TaskID: taskID, Value: value, Timestamp: now}
+
+	if !ok {
+		return nil
+	}
+
+	if previous.TaskID != taskID || value < previous.Value {
+		log.WithFields(log.Fields{"series": series, "task_id": taskID}).Debug("Counter reset - skipping sample")
+		return nil
+	}
+
+	elapsed := now.Sub(previous.Timestamp).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+
+	rate := float64(value-previous.Value) / elapsed
+	return &rate
+}
@@ -0,0 +1,172 @@
+package metrics_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rates", func() {
+	filters := []models.Filter{
+		{Group: "meters", Path: "^requests$"},
+		{Group: "timers", Path: "^resource$"},
+	}
+	start := time.Date(2016, 11, 10, 12, 0, 0, 0, time.UTC)
+
+	sampleAt := func(taskID string, port int64, count uint64) models.GroupedMetrics {
+		return models.GroupedMetrics{
+			"test-service": {
+				{
+					Service: models.ServiceInfo{Name: "test-service", ID: taskID, Host: "localhost", Port: port},
+					Metrics: models.PandoraMetrics{
+						Meters: map[string]models.PandoraMeter{
+							"requests": {Count: count},
+							"ignored":  {Count: count},
+						},
+						Timers: map[string]models.PandoraTimer{"resource": {Count: count * 2}},
+					},
+				},
+			},
+		}
+	}
+	sample := func(taskID string, count uint64) models.GroupedMetrics {
+		return sampleAt(taskID, 31000, count)
+	}
+	meter := func(grouped models.GroupedMetrics, key string) models.PandoraMeter {
+		return grouped["test-service"][0].Metrics.Meters[key]
+	}
+
+	It("Should skip the first sample and compute per second rates", func() {
+		rates := NewRates(filters)
+
+		first := sample("task-1", 100)
+		rates.Apply(first, start)
+		Expect(meter(first, "requests").Rate).To(BeNil())
+
+		second := sample("task-1", 160)
+		rates.Apply(second, start.Add(time.Minute))
+		Expect(meter(second, "requests").Rate).NotTo(BeNil())
+		Expect(*meter(second, "requests").Rate).To(Equal(1.0))
+		Expect(*second["test-service"][0].Metrics.Timers["resource"].Rate).To(Equal(2.0))
+		Expect(meter(second, "ignored").Rate).To(BeNil())
+	})
+
+	It("Should detect counter resets", func() {
+		rates := NewRates(filters)
+		rates.Apply(sample("task-1", 100), start)
+
+		decreased := sample("task-1", 10)
+		rates.Apply(decreased, start.Add(time.Minute))
+		Expect(meter(decreased, "requests").Rate).To(BeNil())
+
+		restarted := sample("task-2", 70)
+		rates.Apply(restarted, start.Add(2*time.Minute))
+		Expect(meter(restarted, "requests").Rate).To(BeNil())
+
+		next := sample("task-2", 100)
+		rates.Apply(next, start.Add(3*time.Minute))
+		Expect(*meter(next, "requests").Rate).To(Equal(0.5))
+	})
+
+	It("Should reset series when another task takes over the address", func() {
+		rates := NewRates(filters)
+		rates.Apply(sample("task-1", 100), start)
+
+		restarted := sample("task-2", 160)
+		rates.Apply(restarted, start.Add(time.Minute))
+		Expect(meter(restarted, "requests").Rate).To(BeNil())
+		Expect(rates.Samples).To(HaveLen(2))
+
+		next := sample("task-2", 220)
+		rates.Apply(next, start.Add(2*time.Minute))
+		Expect(*meter(next, "requests").Rate).To(Equal(1.0))
+	})
+
+	It("Should keep series of tasks sharing a host apart", func() {
+		rates := NewRates(filters)
+		twoTasks := func(first uint64, second uint64) models.GroupedMetrics {
+			grouped := sample("task-1", first)
+			other := sampleAt("task-2", 31001, second)["test-service"][0]
+			grouped["test-service"] = append(grouped["test-service"], other)
+			return grouped
+		}
+		rates.Apply(twoTasks(100, 1000), start)
+
+		next := twoTasks(160, 1120)
+		rates.Apply(next, start.Add(time.Minute))
+		Expect(*next["test-service"][0].Metrics.Meters["requests"].Rate).To(Equal(1.0))
+		Expect(*next["test-service"][1].Metrics.Meters["requests"].Rate).To(Equal(2.0))
+	})
+
+	It("Should emit aggregate rate only when all the instances have one", func() {
+		rates := NewRates(filters)
+		rates.Apply(sample("task-1", 100), start)
+		next := sample("task-1", 160)
+		restarted := sampleAt("task-2", 31001, 10)["test-service"][0]
+		next["test-service"] = append(next["test-service"], restarted)
+		rates.Apply(next, start.Add(time.Minute))
+
+		result, err := Combine(next, filters[:1])
+		Expect(err).NotTo(HaveOccurred())
+		for _, metric := range result {
+			if metric.Fields["service_id"] == "task-1" {
+				Expect(metric.Fields["rate"]).To(Equal(1.0))
+			} else {
+				Expect(metric.Fields).NotTo(HaveKey("rate"))
+			}
+		}
+	})
+
+	It("Should forget samples of series no longer reported", func() {
+		rates := NewRates(filters)
+		rates.Apply(sample("task-1", 100), start)
+		Expect(rates.Samples).To(HaveLen(2))
+
+		rates.Apply(models.GroupedMetrics{}, start.Add(2*DefaultRatesMaxAge))
+		Expect(rates.Samples).To(BeEmpty())
+	})
+
+	It("Should persist samples between runs", func() {
+		dir, err := ioutil.TempDir("", "rates")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "state.json")
+
+		rates, err := LoadRates(path, filters)
+		Expect(err).NotTo(HaveOccurred())
+		rates.Apply(sample("task-1", 100), start)
+		Expect(rates.Save(path)).To(Succeed())
+
+		rates, err = LoadRates(path, filters)
+		Expect(err).NotTo(HaveOccurred())
+		next := sample("task-1", 130)
+		rates.Apply(next, start.Add(time.Minute))
+		Expect(*meter(next, "requests").Rate).To(Equal(0.5))
+
+		Expect(ioutil.WriteFile(path, []byte("{"), 0644)).To(Succeed())
+		rates, err = LoadRates(path, filters)
+		Expect(err).To(HaveOccurred())
+		Expect(rates.Samples).To(BeEmpty())
+	})
+
+	It("Should add rate fields to the filtered metrics", func() {
+		rates := NewRates(filters)
+		rates.Apply(sample("task-1", 100), start)
+		next := sample("task-1", 160)
+		rates.Apply(next, start.Add(time.Minute))
+
+		result, err := Combine(next, filters[:1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(HaveLen(2))
+		for _, metric := range result {
+			Expect(metric.Fields["rate"]).To(Equal(1.0))
+		}
+	})
+})
@@ -1,6 +1,9 @@
 package metrics_test
 
 import (
+	"fmt"
+	"testing"
+
 	. "github.com/Wikia/metrics-fetcher/metrics"
 	"github.com/Wikia/metrics-fetcher/models"
 
@@ -56,6 +59,7 @@ var _ = Describe("Process", func() {
 							"value":      112233.445566,
 							"service_id": "1234-5678-90",
 						},
+						Group: "gauges",
 					},
 					{
 						Measurement: "metric_graphs",
@@ -70,6 +74,7 @@ var _ = Describe("Process", func() {
 							"sum":   112233.445566,
 							"count": 1,
 						},
+						Group: "gauges",
 					},
 				}
 				Expect(measurements).To(ConsistOf(expectedMetrics))
@@ -129,6 +134,7 @@ var _ = Describe("Process", func() {
 							"value":      100.00,
 							"service_id": "1234-5678-90",
 						},
+						Group: "gauges",
 					},
 					{
 						Measurement: filters[0].Measurement,
@@ -141,6 +147,7 @@ var _ = Describe("Process", func() {
 							"value":      20.00,
 							"service_id": "998877-665544-321",
 						},
+						Group: "gauges",
 					},
 					{
 						Measurement: "metric_graphs",
@@ -155,11 +162,162 @@ var _ = Describe("Process", func() {
 							"sum":   120.00,
 							"count": 2,
 						},
+						Group: "gauges",
 					},
 				}
 
 				Expect(measurements).To(ConsistOf(expectedMetrics))
 			})
 		})
+
+		Context("With group_by dimensions", func() {
+			metrics := models.GroupedMetrics{}
+			for i, name := range []string{"service-a", "service-b", "service-b"} {
+				metrics[name] = append(metrics[name], models.SimpleMetrics{
+					Service: models.ServiceInfo{Name: name, ID: fmt.Sprint(i), Host: fmt.Sprintf("host-%d", i%2)},
+					Metrics: models.PandoraMetrics{
+						Gauges: map[string]models.PandoraGauge{"test_metric": {Value: []byte(fmt.Sprint(i + 1))}},
+					},
+				})
+			}
+
+			It("Should aggregate across the services", func() {
+				measurements, err := Combine(metrics, []models.Filter{
+					{Path: "test_metric", Group: "gauges", Emit: []string{"aggregate"}, GroupBy: []string{"host"}},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(measurements).To(ConsistOf(
+					models.FilteredMetrics{
+						Measurement: "metric_graphs",
+						Tags:        map[string]string{"host": "host-0", "metric_name": "test_metric"},
+						Fields:      map[string]interface{}{"min": 1.0, "max": 3.0, "avg": 2.0, "sum": 4.0, "count": 2},
+						Group:       "gauges",
+					},
+					models.FilteredMetrics{
+						Measurement: "metric_graphs",
+						Tags:        map[string]string{"host": "host-1", "metric_name": "test_metric"},
+						Fields:      map[string]interface{}{"min": 2.0, "max": 2.0, "avg": 2.0, "sum": 2.0, "count": 1},
+						Group:       "gauges",
+					},
+				))
+			})
+		})
+
+		Context("With an invalid filter", func() {
+			It("Should return an error", func() {
+				_, err := Combine(models.GroupedMetrics{}, []models.Filter{{Path: "test_(metric", Group: "gauges"}})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Derive()", func() {
+		filtered := []models.FilteredMetrics{
+			{
+				Measurement: "metric_graphs",
+				Tags:        map[string]string{"service_name": "test-service", "metric_name": "errors"},
+				Fields:      map[string]interface{}{"m1_rate": 2.0},
+			},
+			{
+				Measurement: "metric_graphs",
+				Tags:        map[string]string{"service_name": "test-service", "metric_name": "requests"},
+				Fields:      map[string]interface{}{"m1_rate": 8.0},
+			},
+		}
+
+		It("Should append derived metrics", func() {
+			result, err := Derive(filtered, []models.Derived{
+				{
+					Measurement: "error_ratio",
+					Expr:        "errors / requests",
+					Variables: map[string]models.MetricSelector{
+						"errors":   {MetricName: "errors", Field: "m1_rate"},
+						"requests": {MetricName: "requests", Field: "m1_rate"},
+					},
+				},
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(HaveLen(3))
+			Expect(result[2].Measurement).To(Equal("error_ratio"))
+			Expect(result[2].Tags).To(Equal(map[string]string{"service_name": "test-service"}))
+			Expect(result[2].Fields).To(Equal(map[string]interface{}{"value": 0.25}))
+		})
+
+		It("Should return an error for invalid expressions", func() {
+			result, err := Derive(filtered, []models.Derived{{Measurement: "error_ratio", Expr: "errors /"}})
+
+			Expect(err).To(HaveOccurred())
+			Expect(result).To(Equal(filtered))
+		})
 	})
 })
+
+// benchmarkMetrics builds a fleet of instances exposing many metrics, of which the filters select only a few
+func benchmarkMetrics() (models.GroupedMetrics, []models.Filter) {
+	grouped := models.GroupedMetrics{}
+	for i := 0; i < 20; i++ {
+		metrics := models.PandoraMetrics{
+			Gauges: map[string]models.PandoraGauge{},
+			Meters: map[string]models.PandoraMeter{},
+			Timers: map[string]models.PandoraTimer{},
+		}
+		for j := 0; j < 200; j++ {
+			metrics.Gauges[fmt.Sprintf("jvm.memory.pools.pool%d.usage", j)] = models.PandoraGauge{Value: []byte("0.5")}
+			metrics.Meters[fmt.Sprintf("io.dropwizard.jetty.endpoint%d.requests", j)] = models.PandoraMeter{Count: uint64(j), M1Rate: 0.5}
+			metrics.Timers[fmt.Sprintf("com.wikia.Resource.endpoint%d", j)] = models.PandoraTimer{Count: uint64(j), P50: 0.1, P99: 0.5}
+		}
+
+		name := fmt.Sprintf("service-%d", i%4)
+		grouped[name] = append(grouped[name], models.SimpleMetrics{
+			Service: models.ServiceInfo{Name: name, ID: fmt.Sprintf("task-%d", i), Host: "localhost", Port: 1234},
+			Metrics: metrics,
+		})
+	}
+
+	filters := []models.Filter{
+		{Group: "gauges", Path: "jvm\\.memory\\.pools\\.pool1\\.usage", Measurement: "jvm_memory"},
+		{Group: "gauges", Path: "jvm\\.memory\\.pools\\.pool2\\.usage", Measurement: "jvm_memory"},
+		{Group: "meters", Path: "endpoint1[0-9]\\.requests$", Measurement: "http_server"},
+		{Group: "timers", Path: "Resource\\.endpoint5$", Measurement: "http_server"},
+		{Group: "timers", Path: "Resource\\.endpoint6$", Measurement: "http_server"},
+	}
+
+	return grouped, filters
+}
+
+// BenchmarkCombinePerFilter matches every filter separately, compiling its path on each key
+func BenchmarkCombinePerFilter(b *testing.B) {
+	grouped, filters := benchmarkMetrics()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for serviceName, metrics := range grouped {
+			for _, filter := range filters {
+				for _, metric := range metrics {
+					filter.ParseSingle(metric)
+				}
+				filter.ParseMany(serviceName, metrics)
+			}
+		}
+	}
+}
+
+// BenchmarkCombine matches precompiled filters in a single pass per instance
+func BenchmarkCombine(b *testing.B) {
+	grouped, filters := benchmarkMetrics()
+	compiled, err := models.NewFilters(filters)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := Combine(grouped, compiled); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// TLSConfig holds TLS options of HTTPS sinks
+type TLSConfig struct {
+	// CA is a PEM file with certificates of the authorities verifying the server, the system ones by default
+	CA string `mapstructure:"ca"`
+	// Cert and Key are PEM files with the client certificate
+	Cert string `mapstructure:"cert"`
+	Key  string `mapstructure:"key"`
+	// ServerName overrides the name verified in the server certificate
+	ServerName string `mapstructure:"server_name"`
+	// InsecureSkipVerify disables verification of the server certificate
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify"`
+}
+
+// Build returns TLS configuration of the client, nil when no options are set
+func (c TLSConfig) Build() (*tls.Config, error) {
+	if c == (TLSConfig{}) {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+
+	if len(c.CA) != 0 {
+		pem, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Error reading CA file", 0)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("No certificates found in CA file: %s", c.CA)
+		}
+	}
+
+	if len(c.Cert) != 0 || len(c.Key) != 0 {
+		if len(c.Cert) == 0 || len(c.Key) == 0 {
+			return nil, errors.Errorf("Both client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Error loading client certificate", 0)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// resolveSecret returns the configured value or the content of the secret file when the value is empty
+func resolveSecret(value string, file string) (string, error) {
+	if len(value) != 0 {
+		return value, nil
+	}
+
+	if len(file) != 0 {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", errors.WrapPrefix(err, "Error reading secret file", 0)
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,159 @@
+package metrics_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Credentials and TLS", func() {
+	var (
+		server   *httptest.Server
+		dir      string
+		requests []*http.Request
+	)
+
+	metrics := []models.FilteredMetrics{
+		{Measurement: "test-measurement", Tags: map[string]string{"service_name": "test-service"}, Fields: map[string]interface{}{"value": 1.5}},
+	}
+
+	writeFile := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, content, 0600)).To(Succeed())
+		return path
+	}
+
+	write := func(config InfluxConfig) error {
+		config.Address = server.URL
+		sink, err := NewInfluxSink(config)
+		Expect(err).NotTo(HaveOccurred())
+		return sink.Write(context.Background(), metrics, nil, time.Now())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		requests = nil
+		server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	Context("Server certificate", func() {
+		BeforeEach(func() {
+			server.StartTLS()
+		})
+
+		It("Should reject unknown certificate", func() {
+			err := write(InfluxConfig{})
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*WriteError).Kind).To(Equal(WriteErrorNetwork))
+		})
+
+		It("Should skip verification", func() {
+			Expect(write(InfluxConfig{TLS: TLSConfig{InsecureSkipVerify: true}})).To(Succeed())
+		})
+
+		It("Should verify the certificate with the CA", func() {
+			ca := writeFile("ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+			Expect(write(InfluxConfig{TLS: TLSConfig{CA: ca}})).To(Succeed())
+			Expect(requests).To(HaveLen(1))
+		})
+
+		It("Should write to InfluxDB 2.x", func() {
+			token := writeFile("token", []byte("secret\n"))
+			sink, err := NewInflux2Sink(Influx2Config{Address: server.URL, Org: "wikia", Bucket: "services", TokenFile: token, TLS: TLSConfig{InsecureSkipVerify: true}})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(sink.Write(context.Background(), metrics, nil, time.Now())).To(Succeed())
+			Expect(requests[0].Header.Get("Authorization")).To(Equal("Token secret"))
+		})
+	})
+
+	It("Should send the client certificate", func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "metrics-fetcher"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		Expect(err).NotTo(HaveOccurred())
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+		cert := writeFile("cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		keyFile := writeFile("key.pem", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+
+		server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		server.StartTLS()
+
+		Expect(write(InfluxConfig{TLS: TLSConfig{InsecureSkipVerify: true}})).NotTo(Succeed())
+		Expect(write(InfluxConfig{TLS: TLSConfig{InsecureSkipVerify: true, Cert: cert, Key: keyFile}})).To(Succeed())
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].TLS.PeerCertificates[0].Subject.CommonName).To(Equal("metrics-fetcher"))
+	})
+
+	It("Should read credentials from a secret file and ignore the environment", func() {
+		server.Start()
+		password := writeFile("password", []byte("secret\n"))
+		os.Setenv("INFLUXDB_USERNAME", "env-user")
+		os.Setenv("INFLUXDB_PASSWORD", "env-secret")
+		defer os.Unsetenv("INFLUXDB_USERNAME")
+		defer os.Unsetenv("INFLUXDB_PASSWORD")
+
+		Expect(write(InfluxConfig{Username: "foo", PasswordFile: password})).To(Succeed())
+		Expect(write(InfluxConfig{})).To(Succeed())
+		Expect(write(InfluxConfig{Username: "foo", Password: "bar", PasswordFile: password})).To(Succeed())
+
+		credentials := [][]string{}
+		for _, request := range requests {
+			username, password, _ := request.BasicAuth()
+			credentials = append(credentials, []string{username, password})
+		}
+		Expect(credentials).To(Equal([][]string{{"foo", "secret"}, {"", ""}, {"foo", "bar"}}))
+	})
+
+	It("Should reject invalid options", func() {
+		for _, config := range []InfluxConfig{
+			{PasswordFile: filepath.Join(dir, "missing")},
+			{TLS: TLSConfig{CA: filepath.Join(dir, "missing")}},
+			{TLS: TLSConfig{CA: writeFile("empty.pem", []byte("no certificates"))}},
+			{TLS: TLSConfig{Cert: writeFile("cert.pem", []byte{})}},
+		} {
+			config.Address = "https://localhost:8086"
+			_, err := NewInfluxSink(config)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+})
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// WriteErrorKind classifies failures of writes to InfluxDB
+type WriteErrorKind string
+
+const (
+	// WriteErrorAuth means the credentials were rejected
+	WriteErrorAuth WriteErrorKind = "auth"
+	// WriteErrorDatabaseNotFound means the database doesn't exist
+	WriteErrorDatabaseNotFound WriteErrorKind = "database_not_found"
+	// WriteErrorPartial means some of the points were written and the rest was dropped
+	WriteErrorPartial WriteErrorKind = "partial_write"
+	// WriteErrorFieldTypeConflict means a field was sent with a different type than already stored
+	WriteErrorFieldTypeConflict WriteErrorKind = "field_type_conflict"
+	// WriteErrorNetwork means the server couldn't be reached
+	WriteErrorNetwork WriteErrorKind = "network"
+	// WriteErrorUnknown is any other failure
+	WriteErrorUnknown WriteErrorKind = "unknown"
+)
+
+var droppedPattern = regexp.MustCompile(`dropped=(\d+)`)
+
+// WriteError is a failed write of a batch of points
+type WriteError struct {
+	Kind    WriteErrorKind
+	Message string
+	// Points is the number of points in the batch
+	Points int
+	// Dropped is the number of points not written, as reported by the server in partial writes
+	Dropped int
+	Err     error
+}
+
+// NewWriteError classifies an error of writing a batch of points
+func NewWriteError(err error, points int) *WriteError {
+	writeErr := &WriteError{Kind: WriteErrorUnknown, Message: err.Error(), Points: points, Err: err}
+
+	if _, ok := err.(net.Error); ok {
+		writeErr.Kind = WriteErrorNetwork
+		return writeErr
+	}
+
+	// InfluxDB 1.x error responses: {"error":"..."}
+	response := struct {
+		Error string `json:"error"`
+	}{}
+	if json.Unmarshal([]byte(writeErr.Message), &response) == nil && len(response.Error) != 0 {
+		writeErr.Message = response.Error
+	}
+
+	message := strings.ToLower(writeErr.Message)
+	switch {
+	case strings.Contains(message, "partial write"):
+		writeErr.Kind = WriteErrorPartial
+		if match := droppedPattern.FindStringSubmatch(message); match != nil {
+			writeErr.Dropped, _ = strconv.Atoi(match[1])
+		}
+	case strings.Contains(message, "field type conflict"):
+		writeErr.Kind = WriteErrorFieldTypeConflict
+	case strings.Contains(message, "database not found"):
+		writeErr.Kind = WriteErrorDatabaseNotFound
+	case strings.Contains(message, "authorization failed"),
+		strings.Contains(message, "authentication"),
+		strings.Contains(message, "user not found"),
+		strings.Contains(message, "unauthorized"):
+		writeErr.Kind = WriteErrorAuth
+	}
+
+	return writeErr
+}
+
+// newHTTPWriteError classifies an error response of InfluxDB HTTP API: {"error":"..."} (1.x) or
+// {"code":"...","message":"..."} (2.x)
+func newHTTPWriteError(status int, body []byte, points int) *WriteError {
+	message := strings.TrimSpace(string(body))
+	response := struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(body, &response) == nil {
+		if len(response.Error) != 0 {
+			message = response.Error
+		} else if len(response.Message) != 0 {
+			message = response.Message
+		}
+	}
+	if len(message) == 0 {
+		message = http.StatusText(status)
+	}
+
+	writeErr := NewWriteError(errors.New(message), points)
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		writeErr.Kind = WriteErrorAuth
+	case http.StatusNotFound:
+		writeErr.Kind = WriteErrorDatabaseNotFound
+	}
+
+	return writeErr
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("Error writing %d points (%s): %s", e.Points, e.Kind, e.Message)
+}
+
+// DroppedRatio returns the fraction of points not written, all of them unless the server reported a partial write
+func (e *WriteError) DroppedRatio() float64 {
+	if e.Kind != WriteErrorPartial || e.Dropped == 0 || e.Points == 0 {
+		return 1
+	}
+
+	return float64(e.Dropped) / float64(e.Points)
+}
+
+// Temporary tells whether the write may succeed when retried
+func (e *WriteError) Temporary() bool {
+	return e.Kind == WriteErrorNetwork || e.Kind == WriteErrorUnknown
+}
+
+// Spoolable tells whether the batch should be kept for a later write, batches rejected because of their points
+// would fail again
+func (e *WriteError) Spoolable() bool {
+	return e.Kind != WriteErrorPartial && e.Kind != WriteErrorFieldTypeConflict
+}
+
+// mergeWriteErrors merges errors of the failed batches (nil for the written ones) into a single error. Partial
+// writes sum their points, any other failure is returned with the number of points of all the failed batches.
+func mergeWriteErrors(errs []*WriteError) *WriteError {
+	var merged *WriteError
+	points := 0
+	dropped := 0
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		points += err.Points
+		dropped += err.Dropped
+		if merged == nil || (merged.Kind == WriteErrorPartial && err.Kind != WriteErrorPartial) {
+			copied := *err
+			merged = &copied
+		}
+	}
+
+	if merged != nil {
+		merged.Points = points
+		merged.Dropped = dropped
+	}
+
+	return merged
+}
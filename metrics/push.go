@@ -1,77 +1,245 @@
 package metrics
 
 import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/Wikia/metrics-fetcher/models"
 	"github.com/go-errors/errors"
-	"github.com/influxdata/influxdb/client/v2"
 )
 
-// SendMetrics to Influx database
-func SendMetrics(address string, database string, retention string, username string, password string, filteredMetrics []models.FilteredMetrics, extraTags map[string]string, timestamp time.Time) error {
-	if len(filteredMetrics) == 0 {
-		return nil
+const defaultBatchSize = 5000
+
+// influxPrecisions maps precisions of the encoder to the ones of InfluxDB 1.x API
+var influxPrecisions = map[string]string{
+	"ns": "ns",
+	"us": "u",
+	"ms": "ms",
+	"s":  "s",
+}
+
+// InfluxConfig is configuration of InfluxDB 1.x sink
+type InfluxConfig struct {
+	Address   string
+	Database  string
+	Retention string
+	// Username and Password are sent with the writes, the password can be read from PasswordFile
+	Username     string
+	Password     string
+	PasswordFile string    `mapstructure:"password_file"`
+	TLS          TLSConfig `mapstructure:"tls"`
+	// Precision of the timestamps: ns (default), us, ms or s
+	Precision string
+	Timeout   time.Duration
+	// BatchSize limits the number of points in a single write request (5000 by default)
+	BatchSize int `mapstructure:"batch_size"`
+	// Concurrency is the number of batches written in parallel (1 by default)
+	Concurrency int
+	// Retries of a batch failed with a network or server error, the backoff starts at RetryBackoff (1s by default)
+	// and doubles with every retry
+	Retries      int
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+	// SpoolDir keeps batches failed after all the retries until they are replayed by a later write
+	SpoolDir string `mapstructure:"spool_dir"`
+	// SpoolMaxSize limits the size (in bytes) of the spool, 0 means no limit
+	SpoolMaxSize int64 `mapstructure:"spool_max_size"`
+}
+
+// InfluxSink writes metrics to InfluxDB 1.x HTTP API
+type InfluxSink struct {
+	config  InfluxConfig
+	encoder LineEncoder
+	writer  httpWriter
+	spool   *Spool
+}
+
+// NewInfluxSink creates InfluxDB sink, database defaults to "services" and retention policy to "default"
+func NewInfluxSink(config InfluxConfig) (*InfluxSink, error) {
+	var err error
+	if config.Password, err = resolveSecret(config.Password, config.PasswordFile); err != nil {
+		return nil, err
 	}
 
-	log.WithField("db_host", address).Info("Connecting to InfluxDB")
-	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:      address,
-		Username:  username,
-		Password:  password,
-		UserAgent: "metrics-fetcher",
-	})
+	if len(config.Database) == 0 {
+		config.Database = "services"
+	}
+	if len(config.Retention) == 0 {
+		config.Retention = "default"
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
 
+	encoder, err := NewLineEncoder(config.Precision)
 	if err != nil {
-		err = errors.Wrap(err, 0)
-		log.WithError(err).WithField("db_host", address).Error("Error connecting to the database")
-		return err
+		return nil, err
 	}
 
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:        database,
-		RetentionPolicy: retention,
-	})
+	tlsConfig, err := config.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
 
+	address, err := url.Parse(config.Address)
 	if err != nil {
-		err = errors.Wrap(err, 0)
-		log.WithError(err).Error("Error creating batch")
+		return nil, errors.WrapPrefix(err, "Invalid InfluxDB address", 0)
+	}
+	if address.Scheme != "http" && address.Scheme != "https" {
+		return nil, errors.Errorf("Unsupported protocol scheme of InfluxDB address: %s", config.Address)
+	}
+
+	query := url.Values{}
+	query.Set("db", config.Database)
+	query.Set("rp", config.Retention)
+	query.Set("precision", influxPrecisions[encoder.Precision()])
+
+	sink := &InfluxSink{
+		config:  config,
+		encoder: encoder,
+		writer: httpWriter{
+			client:   newHTTPClient(config.Timeout, tlsConfig),
+			url:      strings.TrimRight(config.Address, "/") + "/write?" + query.Encode(),
+			username: config.Username,
+			password: config.Password,
+		},
+	}
+	if len(config.SpoolDir) != 0 {
+		sink.spool = NewSpool(config.SpoolDir, config.SpoolMaxSize)
+	}
+
+	return sink, nil
+}
+
+// Write sends metrics to InfluxDB in batches, replaying the spooled batches first. Failed writes are returned
+// as *WriteError.
+func (s *InfluxSink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	lines := s.encoder.EncodeAll(metrics, tags, timestamp)
+	if len(lines) == 0 && s.spool == nil {
+		log.Warn("No points added to a batch - not sending to Influx")
+		return nil
+	}
+
+	log.WithFields(log.Fields{"db_host": s.config.Address, "points": len(lines)}).Info("Sending metrics to InfluxDB")
+	if s.spool != nil {
+		s.replay(ctx)
+	}
+
+	batches := splitBatches(lines, s.config.BatchSize)
+	failed := make([]*WriteError, len(batches))
+	queue := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < s.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range queue {
+				failed[batch] = s.writeBatch(ctx, batches[batch])
+				if failed[batch] != nil && s.spool != nil && failed[batch].Spoolable() {
+					if err := s.spool.Store(batches[batch]); err != nil {
+						log.WithError(err).WithField("spool", s.config.SpoolDir).Error("Error spooling failed batch")
+					}
+				}
+			}
+		}()
+	}
+	for batch := range batches {
+		queue <- batch
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := mergeWriteErrors(failed); err != nil {
+		log.WithError(err).WithFields(log.Fields{"db_host": s.config.Address, "kind": err.Kind}).Error("Error sending metrics to InfluxDB")
 		return err
 	}
 
-	pointsAdded := 0
-	for _, metrics := range filteredMetrics {
-		if len(metrics.Fields) == 0 {
-			log.Warn("No fields in metric - skipping")
-			continue
+	return nil
+}
+
+// replay writes the spooled batches, the batches that fail again are kept in the spool
+func (s *InfluxSink) replay(ctx context.Context) {
+	batches, err := s.spool.Batches()
+	if err != nil {
+		log.WithError(err).WithField("spool", s.config.SpoolDir).Error("Error reading spooled batches")
+		return
+	}
+
+	for _, batch := range batches {
+		entry := log.WithFields(log.Fields{"spool": s.config.SpoolDir, "batch": batch.Name, "points": len(batch.Lines)})
+		if err := s.writeBatch(ctx, batch.Lines); err != nil {
+			entry.WithError(err).Warn("Error replaying spooled batch")
+			if err.Spoolable() {
+				continue
+			}
+		} else {
+			entry.Info("Spooled batch replayed")
+		}
+
+		if err := s.spool.Remove(batch.Name); err != nil {
+			entry.WithError(err).Error("Error removing replayed batch from the spool")
 		}
-		log.WithField("measurement", metrics.Measurement).Info("Sending metrics")
+	}
+}
+
+// writeBatch writes a batch of lines retrying temporary failures
+func (s *InfluxSink) writeBatch(ctx context.Context, lines []string) *WriteError {
+	return withRetries(ctx, s.config.Retries, s.config.RetryBackoff, func() *WriteError {
+		return s.writer.write(ctx, lines)
+	})
+}
 
-		tags := metrics.Tags
-		for k, v := range extraTags {
-			tags[k] = v
+// withRetries calls write until it succeeds, fails with a permanent error or the retries run out. The backoff
+// doubles with every retry.
+func withRetries(ctx context.Context, retries int, backoff time.Duration, write func() *WriteError) *WriteError {
+	for retry := 0; ; retry++ {
+		writeErr := write()
+		if writeErr == nil {
+			return nil
+		}
+		if retry >= retries || !writeErr.Temporary() {
+			return writeErr
 		}
 
-		pt, err := client.NewPoint(metrics.Measurement, tags, metrics.Fields, timestamp)
-		if err != nil {
-			log.WithError(err).Error("Error adding points to a batch")
-			continue
+		log.WithError(writeErr).WithFields(log.Fields{"retry": retry + 1, "backoff": backoff}).Warn("Retrying write")
+		select {
+		case <-ctx.Done():
+			return writeErr
+		case <-time.After(backoff):
 		}
-		bp.AddPoint(pt)
-		pointsAdded++
+		backoff *= 2
 	}
+}
 
-	if pointsAdded == 0 {
-		log.Warn("No points added to a batch - not sending to Influx")
+// SendMetrics to Influx database, failed writes are returned as *WriteError
+func SendMetrics(address string, database string, retention string, username string, password string, filteredMetrics []models.FilteredMetrics, extraTags map[string]string, timestamp time.Time) error {
+	if len(filteredMetrics) == 0 {
 		return nil
 	}
 
-	err = c.Write(bp)
+	sink, err := NewInfluxSink(InfluxConfig{
+		Address:   address,
+		Database:  database,
+		Retention: retention,
+		Username:  username,
+		Password:  password,
+	})
 	if err != nil {
-		err = errors.Wrap(err, 0)
-		log.WithError(err).Error("Error sending metrics to InfluxDB")
+		return err
 	}
 
-	return nil
+	return sink.Write(context.Background(), filteredMetrics, extraTags, timestamp)
 }
@@ -0,0 +1,292 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+const (
+	// GraphitePlaintext is the Carbon plaintext protocol: "path value timestamp" lines
+	GraphitePlaintext = "plaintext"
+	// GraphitePickle is the Carbon pickle protocol: pickled lists of (path, (timestamp, value)) tuples
+	GraphitePickle = "pickle"
+
+	defaultGraphiteTemplate  = "{service_name}.{host}.{measurement}.{metric_name}.{field}"
+	defaultGraphiteBatchSize = 500
+)
+
+var (
+	graphitePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+	// graphiteDisallowed matches characters replaced in the nodes of the paths, dots included, so a value is
+	// always a single node
+	graphiteDisallowed = regexp.MustCompile(`[^a-zA-Z0-9_:\-]+`)
+)
+
+// GraphiteConfig is configuration of a sink writing to Graphite (Carbon) over TCP
+type GraphiteConfig struct {
+	// Address of Carbon: host:port
+	Address string
+	// Protocol is plaintext (default) or pickle
+	Protocol string
+	// Template of the paths: {measurement}, {field} and tag names in braces, e.g. the default
+	// {service_name}.{host}.{measurement}.{metric_name}.{field}
+	Template string
+	// BatchSize is the maximum number of points in a pickle message, 500 by default
+	BatchSize int `mapstructure:"batch_size"`
+	Timeout   time.Duration
+}
+
+// GraphiteSink writes metrics to Graphite, every numeric field is a separate path
+type GraphiteSink struct {
+	config GraphiteConfig
+}
+
+// graphitePoint is a single value of a path
+type graphitePoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// NewGraphiteSink creates a Graphite sink
+func NewGraphiteSink(config GraphiteConfig) (*GraphiteSink, error) {
+	if len(config.Address) == 0 {
+		return nil, errors.Errorf("Missing address of Graphite sink")
+	}
+	if len(config.Protocol) == 0 {
+		config.Protocol = GraphitePlaintext
+	}
+	if config.Protocol != GraphitePlaintext && config.Protocol != GraphitePickle {
+		return nil, errors.Errorf("Unknown Graphite protocol: %s", config.Protocol)
+	}
+	if len(config.Template) == 0 {
+		config.Template = defaultGraphiteTemplate
+	}
+	if !strings.Contains(config.Template, "{field}") {
+		return nil, errors.Errorf("Graphite template without {field}: %s", config.Template)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultGraphiteBatchSize
+	}
+
+	return &GraphiteSink{config: config}, nil
+}
+
+// Write sends metrics to Carbon, failed writes are returned as *WriteError
+func (s *GraphiteSink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	points := []graphitePoint{}
+	for _, metric := range metrics {
+		points = append(points, s.points(metric, tags, timestamp.Unix())...)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	dialer := net.Dialer{Timeout: s.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.config.Address)
+	if err != nil {
+		return NewWriteError(err, len(points))
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	} else if s.config.Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+	}
+
+	if s.config.Protocol == GraphitePlaintext {
+		_, err = conn.Write(encodeGraphitePlaintext(points))
+	} else {
+		for start := 0; start < len(points) && err == nil; start += s.config.BatchSize {
+			end := start + s.config.BatchSize
+			if end > len(points) {
+				end = len(points)
+			}
+			_, err = conn.Write(encodeGraphitePickle(points[start:end]))
+		}
+	}
+	if err != nil {
+		return NewWriteError(err, len(points))
+	}
+
+	return nil
+}
+
+// points returns values of the numeric fields of a metric (booleans as 0 and 1), other fields, NaN and infinite
+// values are skipped
+func (s *GraphiteSink) points(metric models.FilteredMetrics, extraTags map[string]string, timestamp int64) []graphitePoint {
+	values := map[string]string{}
+	for k, v := range metric.Tags {
+		values[k] = v
+	}
+	for k, v := range extraTags {
+		values[k] = v
+	}
+	values["measurement"] = metric.Measurement
+
+	points := []graphitePoint{}
+	for _, field := range sortedFieldKeys(metric.Fields) {
+		value, ok := graphiteValue(metric.Fields[field])
+		if !ok {
+			continue
+		}
+
+		values["field"] = field
+		path := renderGraphitePath(s.config.Template, values)
+		if len(path) == 0 {
+			continue
+		}
+		points = append(points, graphitePoint{path: path, value: value, timestamp: timestamp})
+	}
+
+	if len(points) == 0 {
+		log.WithField("measurement", metric.Measurement).Debug("Skipping metric without numeric fields")
+	}
+
+	return points
+}
+
+// renderGraphitePath replaces placeholders of the template with sanitized values, nodes left empty (e.g. by
+// missing tags) are skipped
+func renderGraphitePath(template string, values map[string]string) string {
+	nodes := []string{}
+	for _, node := range strings.Split(template, ".") {
+		node = graphitePlaceholder.ReplaceAllStringFunc(node, func(placeholder string) string {
+			return sanitizeGraphiteNode(values[placeholder[1:len(placeholder)-1]])
+		})
+		if len(node) != 0 {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return strings.Join(nodes, ".")
+}
+
+// sanitizeGraphiteNode replaces dots, whitespace and other characters Graphite can't handle in a node with
+// underscores
+func sanitizeGraphiteNode(value string) string {
+	return strings.Trim(graphiteDisallowed.ReplaceAllString(value, "_"), "_")
+}
+
+// graphiteValue returns value of a numeric field, NaN and infinite values are skipped
+func graphiteValue(value interface{}) (float64, bool) {
+	result, ok := numericValue(value)
+	if !ok || math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, false
+	}
+
+	return result, true
+}
+
+// numericValue converts numeric field values to float64, booleans to 0 and 1
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+func encodeGraphitePlaintext(points []graphitePoint) []byte {
+	var buffer bytes.Buffer
+	for _, point := range points {
+		buffer.WriteString(point.path)
+		buffer.WriteByte(' ')
+		buffer.WriteString(strconv.FormatFloat(point.value, 'f', -1, 64))
+		buffer.WriteByte(' ')
+		buffer.WriteString(strconv.FormatInt(point.timestamp, 10))
+		buffer.WriteByte('\n')
+	}
+
+	return buffer.Bytes()
+}
+
+// pickle opcodes (protocol 2) used by the encoder
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+)
+
+// encodeGraphitePickle returns a pickle message: 4 bytes (big endian) of the payload length followed by the pickled
+// list of (path, (timestamp, value)) tuples
+func encodeGraphitePickle(points []graphitePoint) []byte {
+	var payload bytes.Buffer
+	payload.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	for _, point := range points {
+		payload.WriteByte(pickleBinUnicode)
+		binary.Write(&payload, binary.LittleEndian, uint32(len(point.path)))
+		payload.WriteString(point.path)
+
+		if point.timestamp >= math.MinInt32 && point.timestamp <= math.MaxInt32 {
+			payload.WriteByte(pickleBinInt)
+			binary.Write(&payload, binary.LittleEndian, int32(point.timestamp))
+		} else {
+			payload.WriteByte(pickleLong1)
+			payload.WriteByte(8)
+			binary.Write(&payload, binary.LittleEndian, point.timestamp)
+		}
+
+		payload.WriteByte(pickleBinFloat)
+		binary.Write(&payload, binary.BigEndian, math.Float64bits(point.value))
+
+		payload.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+	payload.Write([]byte{pickleAppends, pickleStop})
+
+	message := make([]byte, 4, 4+payload.Len())
+	binary.BigEndian.PutUint32(message, uint32(payload.Len()))
+
+	return append(message, payload.Bytes()...)
+}
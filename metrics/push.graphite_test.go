@@ -0,0 +1,138 @@
+package metrics_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GraphiteSink", func() {
+	var listener net.Listener
+	timestamp := time.Unix(1500000000, 0)
+
+	// receive reads everything written to the first connection of the listener
+	receive := func() chan []byte {
+		received := make(chan []byte, 1)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			content, _ := ioutil.ReadAll(conn)
+			received <- content
+		}()
+		return received
+	}
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("Should write paths in the plaintext protocol", func() {
+		sink, err := NewGraphiteSink(GraphiteConfig{Address: listener.Addr().String()})
+		Expect(err).NotTo(HaveOccurred())
+		received := receive()
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{
+				Measurement: "jvm",
+				Tags:        map[string]string{"service_name": "prod/discussion", "metric_name": "memory.heap used"},
+				Fields:      map[string]interface{}{"value": 1.5, "count": int64(10), "up": true, "unit": "bytes", "rate": math.NaN()},
+			},
+			{
+				Measurement: "jvm",
+				Tags:        map[string]string{"service_name": "discussion"},
+				Fields:      map[string]interface{}{"unit": "bytes"},
+			},
+		}, map[string]string{"host": "10.8.0.1"}, timestamp)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(<-received)).To(Equal(
+			"prod_discussion.10_8_0_1.jvm.memory_heap_used.count 10 1500000000\n" +
+				"prod_discussion.10_8_0_1.jvm.memory_heap_used.up 1 1500000000\n" +
+				"prod_discussion.10_8_0_1.jvm.memory_heap_used.value 1.5 1500000000\n"))
+	})
+
+	It("Should render a custom template skipping missing nodes", func() {
+		sink, err := NewGraphiteSink(GraphiteConfig{Address: listener.Addr().String(), Template: "services.{service_name}.{env}.{metric_name}_{field}"})
+		Expect(err).NotTo(HaveOccurred())
+		received := receive()
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{Measurement: "jvm", Tags: map[string]string{"service_name": "discussion", "metric_name": "gc"}, Fields: map[string]interface{}{"count": 3}},
+		}, nil, timestamp)
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(<-received)).To(Equal("services.discussion.gc_count 3 1500000000\n"))
+	})
+
+	It("Should write paths in the pickle protocol", func() {
+		sink, err := NewGraphiteSink(GraphiteConfig{Address: listener.Addr().String(), Protocol: GraphitePickle, Template: "{metric_name}.{field}", BatchSize: 1})
+		Expect(err).NotTo(HaveOccurred())
+		received := receive()
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{Measurement: "jvm", Tags: map[string]string{"metric_name": "a"}, Fields: map[string]interface{}{"b": 1.5}},
+			{Measurement: "jvm", Tags: map[string]string{"metric_name": "c"}, Fields: map[string]interface{}{"d": 2}},
+		}, nil, timestamp)
+		Expect(err).NotTo(HaveOccurred())
+
+		// pickle.dumps([(path, (1500000000, value))], protocol=2) without the memo opcodes
+		pickled := func(path string, value []byte) []byte {
+			payload := []byte{0x80, 0x02, ']', '(', 'X', byte(len(path)), 0, 0, 0}
+			payload = append(payload, path...)
+			payload = append(payload, 'J', 0x00, 0x2f, 0x68, 0x59, 'G')
+			payload = append(payload, value...)
+			payload = append(payload, 0x86, 0x86, 'e', '.')
+
+			header := make([]byte, 4)
+			binary.BigEndian.PutUint32(header, uint32(len(payload)))
+			return append(header, payload...)
+		}
+		expected := append(
+			pickled("a.b", []byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0}),
+			pickled("c.d", []byte{0x40, 0x00, 0, 0, 0, 0, 0, 0})...)
+		Expect(<-received).To(Equal(expected))
+	})
+
+	It("Should return network errors", func() {
+		address := listener.Addr().String()
+		listener.Close()
+		sink, err := NewGraphiteSink(GraphiteConfig{Address: address})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{Measurement: "jvm", Fields: map[string]interface{}{"value": 1}},
+		}, nil, timestamp)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*WriteError).Kind).To(Equal(WriteErrorNetwork))
+		Expect(err.(*WriteError).Points).To(Equal(1))
+	})
+
+	It("Should reject invalid options", func() {
+		for _, config := range []GraphiteConfig{
+			{},
+			{Address: "localhost:2003", Protocol: "udp"},
+			{Address: "localhost:2003", Template: "{service_name}.{metric_name}"},
+		} {
+			_, err := NewGraphiteSink(config)
+			Expect(err).To(HaveOccurred())
+		}
+	})
+})
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpWriter posts batches of line protocol to a write endpoint of InfluxDB HTTP API, other payloads are sent with
+// send
+type httpWriter struct {
+	client *http.Client
+	// url of the endpoint with the query
+	url      string
+	username string
+	password string
+	token    string
+	gzip     bool
+}
+
+// newHTTPClient creates a client with the settings of the default transport (proxy from the environment, dial,
+// TLS handshake and idle timeouts) and the given TLS configuration
+func newHTTPClient(timeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	defaults := http.DefaultTransport.(*http.Transport)
+	transport := &http.Transport{
+		Proxy:                 defaults.Proxy,
+		DialContext:           defaults.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   defaults.TLSHandshakeTimeout,
+		MaxIdleConns:          defaults.MaxIdleConns,
+		IdleConnTimeout:       defaults.IdleConnTimeout,
+		ExpectContinueTimeout: defaults.ExpectContinueTimeout,
+	}
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// write sends a batch of lines, failures are returned as *WriteError
+func (w httpWriter) write(ctx context.Context, lines []string) *WriteError {
+	body := []byte(strings.Join(lines, ""))
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.gzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(body)
+		writer.Close()
+		body = compressed.Bytes()
+		header.Set("Content-Encoding", "gzip")
+	}
+
+	return w.send(ctx, "POST", body, header, len(lines))
+}
+
+// send sends a request with the body of the given number of points, responses other than 2xx are returned as
+// *WriteError
+func (w httpWriter) send(ctx context.Context, method string, body []byte, header http.Header, points int) *WriteError {
+	request, err := http.NewRequest(method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return NewWriteError(err, points)
+	}
+	request = request.WithContext(ctx)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("User-Agent", "metrics-fetcher")
+	if len(w.username) != 0 {
+		request.SetBasicAuth(w.username, w.password)
+	}
+	if len(w.token) != 0 {
+		request.Header.Set("Authorization", "Token "+w.token)
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return NewWriteError(err, points)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	content, _ := ioutil.ReadAll(response.Body)
+
+	return newHTTPWriteError(response.StatusCode, content, points)
+}
+
+// splitBatches splits lines into batches of at most size lines
+func splitBatches(lines []string, size int) [][]string {
+	batches := [][]string{}
+	for start := 0; start < len(lines); start += size {
+		end := start + size
+		if end > len(lines) {
+			end = len(lines)
+		}
+		batches = append(batches, lines[start:end])
+	}
+
+	return batches
+}
@@ -0,0 +1,28 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPClientKeepsDefaultTransportSettings(t *testing.T) {
+	//given
+	tlsConfig := &tls.Config{ServerName: "influx"}
+
+	//when
+	client := newHTTPClient(time.Second, tlsConfig)
+
+	//then
+	transport := client.Transport.(*http.Transport)
+	assert.Equal(t, time.Second, client.Timeout)
+	assert.Equal(t, tlsConfig, transport.TLSClientConfig)
+	assert.NotNil(t, transport.Proxy)
+	assert.NotNil(t, transport.DialContext)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).IdleConnTimeout, transport.IdleConnTimeout)
+	assert.Equal(t, http.DefaultTransport.(*http.Transport).TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.NotEqual(t, http.DefaultTransport, client.Transport)
+}
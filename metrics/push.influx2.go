@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+// Influx2Config is configuration of InfluxDB 2.x sink
+type Influx2Config struct {
+	Address string
+	Org     string
+	Bucket  string
+	// Token can be read from TokenFile
+	Token     string
+	TokenFile string    `mapstructure:"token_file"`
+	TLS       TLSConfig `mapstructure:"tls"`
+	// Precision of the timestamps: ns (default), us, ms or s
+	Precision string
+	// Gzip compresses the request bodies
+	Gzip    bool
+	Timeout time.Duration
+	// BatchSize limits the number of points in a single write request (5000 by default)
+	BatchSize int `mapstructure:"batch_size"`
+	// Retries of a batch failed with a network or server error, the backoff starts at RetryBackoff (1s by default)
+	// and doubles with every retry
+	Retries      int
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+}
+
+// Influx2Sink writes metrics to InfluxDB 2.x HTTP API (/api/v2/write)
+type Influx2Sink struct {
+	config  Influx2Config
+	encoder LineEncoder
+	writer  httpWriter
+}
+
+// NewInflux2Sink creates InfluxDB 2.x sink
+func NewInflux2Sink(config Influx2Config) (*Influx2Sink, error) {
+	if len(config.Address) == 0 || len(config.Org) == 0 || len(config.Bucket) == 0 {
+		return nil, errors.Errorf("Address, org and bucket of InfluxDB 2.x sink are required")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	encoder, err := NewLineEncoder(config.Precision)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Token, err = resolveSecret(config.Token, config.TokenFile); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := config.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	query.Set("precision", encoder.Precision())
+
+	return &Influx2Sink{
+		config:  config,
+		encoder: encoder,
+		writer: httpWriter{
+			client: newHTTPClient(config.Timeout, tlsConfig),
+			url:    strings.TrimRight(config.Address, "/") + "/api/v2/write?" + query.Encode(),
+			token:  config.Token,
+			gzip:   config.Gzip,
+		},
+	}, nil
+}
+
+// Write sends metrics to InfluxDB in batches, failed writes are returned as *WriteError
+func (s *Influx2Sink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	failed := []*WriteError{}
+	for _, batch := range splitBatches(s.encoder.EncodeAll(metrics, tags, timestamp), s.config.BatchSize) {
+		err := withRetries(ctx, s.config.Retries, s.config.RetryBackoff, func() *WriteError {
+			return s.writer.write(ctx, batch)
+		})
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if err := mergeWriteErrors(failed); err != nil {
+		log.WithError(err).WithFields(log.Fields{"db_host": s.config.Address, "kind": err.Kind}).Error("Error sending metrics to InfluxDB")
+		return err
+	}
+
+	return nil
+}
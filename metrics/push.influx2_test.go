@@ -0,0 +1,105 @@
+package metrics_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Influx2Sink", func() {
+	var (
+		server   *httptest.Server
+		requests []*http.Request
+		bodies   []string
+		status   int
+		response string
+	)
+
+	timestamp := time.Unix(1500000000, 123456789)
+	metrics := []models.FilteredMetrics{
+		{
+			Measurement: "test-measurement",
+			Tags:        map[string]string{"service_name": "test-service"},
+			Fields:      map[string]interface{}{"value": 1.5},
+		},
+	}
+
+	BeforeEach(func() {
+		requests = nil
+		bodies = nil
+		status = http.StatusNoContent
+		response = ""
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reader := r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				reader, _ = gzip.NewReader(r.Body)
+			}
+			body, _ := ioutil.ReadAll(reader)
+			requests = append(requests, r)
+			bodies = append(bodies, string(body))
+			w.WriteHeader(status)
+			w.Write([]byte(response))
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("Should write to the v2 API", func() {
+		sink, err := NewInflux2Sink(Influx2Config{Address: server.URL, Org: "wikia", Bucket: "services", Token: "secret", Precision: "ms", Gzip: true})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(sink.Write(context.Background(), metrics, map[string]string{"foo": "bar"}, timestamp)).To(Succeed())
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Method).To(Equal("POST"))
+		Expect(requests[0].URL.Path).To(Equal("/api/v2/write"))
+		Expect(requests[0].URL.Query().Get("org")).To(Equal("wikia"))
+		Expect(requests[0].URL.Query().Get("bucket")).To(Equal("services"))
+		Expect(requests[0].URL.Query().Get("precision")).To(Equal("ms"))
+		Expect(requests[0].Header.Get("Authorization")).To(Equal("Token secret"))
+		Expect(requests[0].Header.Get("Content-Encoding")).To(Equal("gzip"))
+		Expect(bodies[0]).To(Equal("test-measurement,foo=bar,service_name=test-service value=1.5 1500000000123\n"))
+	})
+
+	It("Should classify error responses", func() {
+		sink, err := NewInflux2Sink(Influx2Config{Address: server.URL, Org: "wikia", Bucket: "services"})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, r := range []struct {
+			status   int
+			response string
+			kind     WriteErrorKind
+		}{
+			{http.StatusUnauthorized, `{"code":"unauthorized","message":"unauthorized access"}`, WriteErrorAuth},
+			{http.StatusNotFound, `{"code":"not found","message":"bucket \"services\" not found"}`, WriteErrorDatabaseNotFound},
+			{http.StatusUnprocessableEntity, `{"code":"unprocessable entity","message":"failure writing points to database: partial write: field type conflict dropped=1"}`, WriteErrorPartial},
+			{http.StatusServiceUnavailable, ``, WriteErrorUnknown},
+		} {
+			status, response = r.status, r.response
+
+			err := sink.Write(context.Background(), metrics, nil, timestamp)
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*WriteError).Kind).To(Equal(r.kind), r.response)
+		}
+	})
+
+	It("Should reject invalid configuration", func() {
+		_, err := NewInflux2Sink(Influx2Config{Address: server.URL, Org: "wikia"})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewInflux2Sink(Influx2Config{Address: server.URL, Org: "wikia", Bucket: "services", Precision: "h"})
+		Expect(err).To(HaveOccurred())
+	})
+})
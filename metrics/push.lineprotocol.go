@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+// precisions of the timestamps
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// newlines end a point in the line protocol, they are written as \n in names, tags and string fields
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	fieldKeyEscaper    = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, `"`, `\"`, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// ErrNoFields is returned for metrics without any field that can be encoded
+var ErrNoFields = errors.New("no fields to encode")
+
+// LineEncoder encodes metrics into InfluxDB line protocol. Tags and fields are sorted by their keys, so the same
+// metric is always encoded the same way. Integers get the "i" suffix, floats which are NaN or infinite (not
+// supported by InfluxDB) are skipped, as are tags with empty values.
+type LineEncoder struct {
+	precision string
+}
+
+// NewLineEncoder creates an encoder with timestamps in the given precision: ns (default), us, ms or s
+func NewLineEncoder(precision string) (LineEncoder, error) {
+	if len(precision) == 0 {
+		precision = "ns"
+	}
+	if _, ok := precisions[precision]; !ok {
+		return LineEncoder{}, errors.Errorf("Unknown precision: %s", precision)
+	}
+
+	return LineEncoder{precision: precision}, nil
+}
+
+// Precision returns precision of the timestamps
+func (e LineEncoder) Precision() string {
+	if len(e.precision) == 0 {
+		return "ns"
+	}
+	return e.precision
+}
+
+// Encode returns the line (with the trailing newline) of a metric with the extra tags, zero timestamp is omitted
+func (e LineEncoder) Encode(metric models.FilteredMetrics, extraTags map[string]string, timestamp time.Time) (string, error) {
+	var line bytes.Buffer
+
+	line.WriteString(measurementEscaper.Replace(metric.Measurement))
+
+	tags := map[string]string{}
+	for k, v := range metric.Tags {
+		tags[k] = v
+	}
+	for k, v := range extraTags {
+		tags[k] = v
+	}
+	for _, key := range sortedKeys(tags) {
+		if len(key) == 0 || len(tags[key]) == 0 {
+			continue
+		}
+		line.WriteByte(',')
+		line.WriteString(keyEscaper.Replace(key))
+		line.WriteByte('=')
+		line.WriteString(keyEscaper.Replace(tags[key]))
+	}
+
+	fields := 0
+	for _, key := range sortedFieldKeys(metric.Fields) {
+		value, ok := formatFieldValue(metric.Fields[key])
+		if !ok || len(key) == 0 {
+			continue
+		}
+		if fields == 0 {
+			line.WriteByte(' ')
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(fieldKeyEscaper.Replace(key))
+		line.WriteByte('=')
+		line.WriteString(value)
+		fields++
+	}
+	if fields == 0 {
+		return "", ErrNoFields
+	}
+
+	if !timestamp.IsZero() {
+		line.WriteByte(' ')
+		line.WriteString(strconv.FormatInt(timestamp.UnixNano()/int64(precisions[e.Precision()]), 10))
+	}
+	line.WriteByte('\n')
+
+	return line.String(), nil
+}
+
+// EncodeAll returns lines of all the metrics, metrics without fields are skipped
+func (e LineEncoder) EncodeAll(metrics []models.FilteredMetrics, extraTags map[string]string, timestamp time.Time) []string {
+	lines := []string{}
+	for _, metric := range metrics {
+		line, err := e.Encode(metric, extraTags, timestamp)
+		if err != nil {
+			log.WithError(err).WithField("measurement", metric.Measurement).Warn("Skipping metric")
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+func formatFieldValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case float64:
+		return formatFloat(v, 64)
+	case float32:
+		return formatFloat(float64(v), 32)
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int8:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int16:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case uint:
+		return formatUint(uint64(v))
+	case uint8:
+		return formatUint(uint64(v))
+	case uint16:
+		return formatUint(uint64(v))
+	case uint32:
+		return formatUint(uint64(v))
+	case uint64:
+		return formatUint(v)
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	case nil:
+		return "", false
+	default:
+		return `"` + stringEscaper.Replace(fmt.Sprintf("%v", v)) + `"`, true
+	}
+}
+
+func formatFloat(value float64, bitSize int) (string, bool) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", false
+	}
+
+	return strconv.FormatFloat(value, 'f', -1, bitSize), true
+}
+
+// formatUint encodes unsigned integers as signed ones (InfluxDB 1.x doesn't support unsigned), the ones out of
+// the range are skipped
+func formatUint(value uint64) (string, bool) {
+	if value > math.MaxInt64 {
+		return "", false
+	}
+
+	return strconv.FormatUint(value, 10) + "i", true
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func sortedFieldKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
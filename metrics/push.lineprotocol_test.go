@@ -0,0 +1,109 @@
+package metrics_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+var _ = Describe("LineEncoder", func() {
+	timestamp := time.Unix(1500000000, 123456789)
+
+	metrics := []models.FilteredMetrics{
+		{
+			Measurement: "http_server",
+			Tags:        map[string]string{"service_name": "discussion", "host": "10.8.0.1", "metric_name": "requests"},
+			Fields:      map[string]interface{}{"value": 12.5, "count": int64(42), "m1_rate": float32(0.25), "active": true},
+		},
+		{
+			Measurement: "types",
+			Fields: map[string]interface{}{
+				"int": 1, "int8": int8(-8), "int16": int16(16), "int32": int32(-32),
+				"uint": uint(1), "uint8": uint8(8), "uint16": uint16(16), "uint32": uint32(32), "uint64": uint64(64),
+				"float": 1e21, "small": 0.000001, "zero": 0.0, "negative": -1.5,
+			},
+		},
+		{
+			Measurement: "escaping, measurement=name",
+			Tags:        map[string]string{"tag key,=": "tag value,=", "empty": ""},
+			Fields:      map[string]interface{}{`field "key",=`: `string "value" with \ backslash`, "other": struct{ A int }{1}},
+		},
+		{
+			Measurement: "non_finite",
+			Tags:        map[string]string{"service_name": "discussion"},
+			Fields:      map[string]interface{}{"nan": math.NaN(), "inf": math.Inf(1), "value": 1.0, "too_big": uint64(math.MaxUint64), "missing": nil},
+		},
+		{
+			Measurement: "only_nan",
+			Fields:      map[string]interface{}{"nan": math.NaN(), "inf": math.Inf(-1)},
+		},
+		{
+			Measurement: "no_fields",
+			Tags:        map[string]string{"service_name": "discussion"},
+		},
+	}
+	extraTags := map[string]string{"env": "prod", "service_name": "overridden"}
+
+	golden := func(name string, lines []string) {
+		path := filepath.Join("testdata", name)
+		output := strings.Join(lines, "")
+		if *updateGolden {
+			Expect(ioutil.WriteFile(path, []byte(output), 0644)).To(Succeed())
+		}
+
+		expected, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(output).To(Equal(string(expected)))
+	}
+
+	It("Should encode metrics deterministically", func() {
+		encoder, err := NewLineEncoder("")
+		Expect(err).NotTo(HaveOccurred())
+
+		for i := 0; i < 10; i++ {
+			golden("lineprotocol.golden", encoder.EncodeAll(metrics, extraTags, timestamp))
+		}
+	})
+
+	It("Should encode timestamps in the given precision", func() {
+		lines := []string{}
+		for _, precision := range []string{"ns", "us", "ms", "s"} {
+			encoder, err := NewLineEncoder(precision)
+			Expect(err).NotTo(HaveOccurred())
+			lines = append(lines, encoder.EncodeAll(metrics[:1], nil, timestamp)...)
+		}
+		lines = append(lines, LineEncoder{}.EncodeAll(metrics[:1], nil, time.Time{})...)
+
+		golden("lineprotocol.precision.golden", lines)
+	})
+
+	It("Should escape newlines", func() {
+		line, err := LineEncoder{}.Encode(models.FilteredMetrics{
+			Measurement: "multi\nline",
+			Tags:        map[string]string{"tag\nkey": "tag\nvalue"},
+			Fields:      map[string]interface{}{"field\nkey": "string\nvalue"},
+		}, nil, time.Time{})
+
+		Expect(err).NotTo(HaveOccurred())
+		Expect(line).To(Equal(`multi\nline,tag\nkey=tag\nvalue field\nkey="string\nvalue"` + "\n"))
+	})
+
+	It("Should report metrics without fields", func() {
+		_, err := LineEncoder{}.Encode(metrics[4], nil, timestamp)
+		Expect(err).To(Equal(ErrNoFields))
+
+		_, err = NewLineEncoder("m")
+		Expect(err).To(HaveOccurred())
+	})
+})
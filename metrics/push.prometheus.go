@@ -0,0 +1,294 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+)
+
+// types of the Prometheus metrics
+const (
+	prometheusCounter = "counter"
+	prometheusGauge   = "gauge"
+	prometheusUntyped = "untyped"
+)
+
+// prometheusContentType is the content type of the text exposition format
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	prometheusInvalidNameChars  = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	prometheusInvalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	prometheusLabelEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// prometheusLabel is a single label of a series
+type prometheusLabel struct {
+	name  string
+	value string
+}
+
+// prometheusLabels sorts labels by their names
+type prometheusLabels []prometheusLabel
+
+func (l prometheusLabels) Len() int           { return len(l) }
+func (l prometheusLabels) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l prometheusLabels) Less(i, j int) bool { return l[i].name < l[j].name }
+
+// prometheusSeries is a sample of a metric mapped to Prometheus data model
+type prometheusSeries struct {
+	name       string
+	metricType string
+	// labels sorted by their names
+	labels []prometheusLabel
+	value  float64
+	// timestamp in milliseconds, zero means none
+	timestamp int64
+}
+
+// prometheusSeriesList sorts series by their ids
+type prometheusSeriesList []prometheusSeries
+
+func (l prometheusSeriesList) Len() int           { return len(l) }
+func (l prometheusSeriesList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l prometheusSeriesList) Less(i, j int) bool { return l[i].id() < l[j].id() }
+
+// id uniquely identifies the series by its name and labels
+func (s prometheusSeries) id() string {
+	parts := []string{s.name}
+	for _, label := range s.labels {
+		parts = append(parts, label.name+"="+label.value)
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+// text returns the series in the text exposition format (without the type)
+func (s prometheusSeries) text() string {
+	var line bytes.Buffer
+	line.WriteString(s.name)
+	if len(s.labels) != 0 {
+		line.WriteByte('{')
+		for i, label := range s.labels {
+			if i != 0 {
+				line.WriteByte(',')
+			}
+			line.WriteString(label.name)
+			line.WriteString(`="`)
+			line.WriteString(prometheusLabelEscaper.Replace(label.value))
+			line.WriteByte('"')
+		}
+		line.WriteByte('}')
+	}
+	line.WriteByte(' ')
+	line.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+	if s.timestamp != 0 {
+		line.WriteByte(' ')
+		line.WriteString(strconv.FormatInt(s.timestamp, 10))
+	}
+	line.WriteByte('\n')
+
+	return line.String()
+}
+
+// prometheusType chooses the type by the Dropwizard group and the field before it was renamed: gauges are gauges,
+// the value (count) of meters and timers is a counter and their other fields (rates, percentiles) are gauges.
+// Derived metrics are untyped.
+func prometheusType(group string, field string) string {
+	switch group {
+	case "gauges":
+		return prometheusGauge
+	case "meters", "timers":
+		if field == "value" {
+			return prometheusCounter
+		}
+		return prometheusGauge
+	default:
+		return prometheusUntyped
+	}
+}
+
+// prometheusName returns a valid metric name: invalid characters are replaced with underscores, names starting
+// with a digit are prefixed with an underscore
+func prometheusName(name string) string {
+	name = prometheusInvalidNameChars.ReplaceAllString(name, "_")
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// prometheusLabelName returns a valid label name, the same way as prometheusName but without colons
+func prometheusLabelName(name string) string {
+	return prometheusName(prometheusInvalidLabelChars.ReplaceAllString(name, "_"))
+}
+
+// prometheusSeriesOf maps metrics to Prometheus series: every numeric field (booleans as 0 and 1) is a metric named
+// <measurement>_<field> (counters get the _total suffix) labeled with the tags and the extra tags. Other fields,
+// duplicated series and empty tags are skipped.
+func prometheusSeriesOf(metrics []models.FilteredMetrics, extraTags map[string]string) []prometheusSeries {
+	result := []prometheusSeries{}
+	seen := map[string]bool{}
+
+	for _, metric := range metrics {
+		tags := map[string]string{}
+		for k, v := range metric.Tags {
+			tags[k] = v
+		}
+		for k, v := range extraTags {
+			tags[k] = v
+		}
+
+		labels := []prometheusLabel{}
+		names := map[string]bool{}
+		for _, key := range sortedKeys(tags) {
+			name := prometheusLabelName(key)
+			if len(tags[key]) == 0 || strings.HasPrefix(name, "__") || names[name] {
+				continue
+			}
+			names[name] = true
+			labels = append(labels, prometheusLabel{name: name, value: tags[key]})
+		}
+		sort.Sort(prometheusLabels(labels))
+
+		for _, field := range sortedFieldKeys(metric.Fields) {
+			value, ok := numericValue(metric.Fields[field])
+			if !ok {
+				continue
+			}
+
+			series := prometheusSeries{
+				name:       prometheusName(metric.Measurement + "_" + field),
+				metricType: prometheusType(metric.Group, metric.SourceField(field)),
+				labels:     labels,
+				value:      value,
+			}
+			if series.metricType == prometheusCounter && !strings.HasSuffix(series.name, "_total") {
+				series.name += "_total"
+			}
+
+			id := series.id()
+			if seen[id] {
+				log.WithFields(log.Fields{"measurement": metric.Measurement, "field": field}).Debug("Skipping duplicated Prometheus series")
+				continue
+			}
+			seen[id] = true
+			result = append(result, series)
+		}
+	}
+
+	return result
+}
+
+// PrometheusConfig is configuration of the Prometheus exporter
+type PrometheusConfig struct {
+	// StaleAfter keeps series missing from the latest cycle exposed (with the timestamp of their last sample) for
+	// the given time, by default they are removed at once and Prometheus marks them stale
+	StaleAfter time.Duration `mapstructure:"stale_after"`
+}
+
+// exportedSeries is a series exposed by the exporter with the time of the cycle it was last written in
+type exportedSeries struct {
+	prometheusSeries
+	timestamp time.Time
+}
+
+// PrometheusExporter keeps the latest metrics and serves them in Prometheus text exposition format
+type PrometheusExporter struct {
+	config PrometheusConfig
+	series map[string]exportedSeries
+	// latest is the time of the latest cycle
+	latest time.Time
+	mutex  sync.RWMutex
+}
+
+// NewPrometheusExporter creates an exporter without any series
+func NewPrometheusExporter(config PrometheusConfig) *PrometheusExporter {
+	return &PrometheusExporter{config: config, series: map[string]exportedSeries{}}
+}
+
+// Write replaces exposed series with the metrics of a cycle, series missing from it are kept until they are stale
+func (e *PrometheusExporter) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	series := prometheusSeriesOf(metrics, tags)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.latest = timestamp
+	for _, s := range series {
+		e.series[s.id()] = exportedSeries{prometheusSeries: s, timestamp: timestamp}
+	}
+	for id, s := range e.series {
+		if s.timestamp.Before(timestamp) && !s.timestamp.Add(e.config.StaleAfter).After(timestamp) {
+			delete(e.series, id)
+		}
+	}
+
+	return nil
+}
+
+// ServeHTTP writes the exposed series. Series missing from the latest cycle have the timestamp of their last sample,
+// so Prometheus doesn't take the old value for a new one.
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mutex.RLock()
+	series := make([]prometheusSeries, 0, len(e.series))
+	for _, s := range e.series {
+		if s.timestamp.Before(e.latest) {
+			s.prometheusSeries.timestamp = s.timestamp.UnixNano() / int64(time.Millisecond)
+		}
+		series = append(series, s.prometheusSeries)
+	}
+	e.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", prometheusContentType)
+	w.Write(formatPrometheusText(series))
+}
+
+// formatPrometheusText returns series in the text exposition format, metrics are sorted by their names and series
+// by their labels
+func formatPrometheusText(series []prometheusSeries) []byte {
+	byName := map[string][]prometheusSeries{}
+	for _, s := range series {
+		byName[s.name] = append(byName[s.name], s)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	for _, name := range names {
+		series := byName[name]
+		sort.Sort(prometheusSeriesList(series))
+
+		// a name has a single type, the same name mapped from fields of different groups is untyped
+		metricType := series[0].metricType
+		for _, s := range series {
+			if s.metricType != metricType {
+				metricType = prometheusUntyped
+			}
+		}
+
+		body.WriteString("# TYPE " + name + " " + metricType + "\n")
+		for _, s := range series {
+			body.WriteString(s.text())
+		}
+	}
+
+	return body.Bytes()
+}
@@ -0,0 +1,119 @@
+package metrics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PrometheusExporter", func() {
+	timestamp := time.Unix(1500000000, 0)
+
+	scrape := func(exporter *PrometheusExporter) string {
+		recorder := httptest.NewRecorder()
+		exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		body, _ := ioutil.ReadAll(recorder.Body)
+		return string(body)
+	}
+
+	It("Should expose metrics with types chosen by the group", func() {
+		exporter := NewPrometheusExporter(PrometheusConfig{})
+
+		err := exporter.Write(context.Background(), []models.FilteredMetrics{
+			{
+				Measurement: "jvm.memory",
+				Tags:        map[string]string{"service_name": "discussion", "metric_name": "heap", "pool": "", "2xx": "a\"b\\c\nd"},
+				Fields:      map[string]interface{}{"value": 1.5, "service_id": "1", "ok": true},
+				Group:       "gauges",
+			},
+			{
+				Measurement: "requests",
+				Tags:        map[string]string{"service_name": "discussion"},
+				Fields:      map[string]interface{}{"value": int64(10), "m1_rate": math.Inf(1)},
+				Group:       "timers",
+			},
+			{
+				Measurement: "errors",
+				Fields:      map[string]interface{}{"ratio": 0.25},
+			},
+		}, map[string]string{"env": "prod"}, timestamp)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(scrape(exporter)).To(Equal(
+			"# TYPE errors_ratio untyped\n" +
+				"errors_ratio{env=\"prod\"} 0.25\n" +
+				"# TYPE jvm_memory_ok gauge\n" +
+				"jvm_memory_ok{_2xx=\"a\\\"b\\\\c\\nd\",env=\"prod\",metric_name=\"heap\",service_name=\"discussion\"} 1\n" +
+				"# TYPE jvm_memory_value gauge\n" +
+				"jvm_memory_value{_2xx=\"a\\\"b\\\\c\\nd\",env=\"prod\",metric_name=\"heap\",service_name=\"discussion\"} 1.5\n" +
+				"# TYPE requests_m1_rate gauge\n" +
+				"requests_m1_rate{env=\"prod\",service_name=\"discussion\"} +Inf\n" +
+				"# TYPE requests_value_total counter\n" +
+				"requests_value_total{env=\"prod\",service_name=\"discussion\"} 10\n"))
+	})
+
+	It("Should choose types by the fields before they are renamed", func() {
+		exporter := NewPrometheusExporter(PrometheusConfig{})
+		grouped := models.GroupedMetrics{
+			"discussion": {
+				{
+					Service: models.ServiceInfo{Name: "discussion", ID: "1", Host: "localhost"},
+					Metrics: models.PandoraMetrics{Meters: map[string]models.PandoraMeter{"requests": {Count: 10, M1Rate: 0.5}}},
+				},
+			},
+		}
+		metrics, err := Combine(grouped, []models.Filter{
+			{Group: "meters", Path: "^requests$", Measurement: "http", Emit: []string{"instance"}, Fields: map[string]string{"value": "requests", "m1_rate": "value"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(exporter.Write(context.Background(), metrics, nil, timestamp)).To(Succeed())
+
+		Expect(scrape(exporter)).To(Equal(
+			"# TYPE http_requests_total counter\n" +
+				"http_requests_total{host=\"localhost\",metric_name=\"requests\",service_name=\"discussion\"} 10\n" +
+				"# TYPE http_value gauge\n" +
+				"http_value{host=\"localhost\",metric_name=\"requests\",service_name=\"discussion\"} 0.5\n"))
+	})
+
+	It("Should remove series missing from the latest cycle", func() {
+		exporter := NewPrometheusExporter(PrometheusConfig{})
+		metric := func(service string, value float64) models.FilteredMetrics {
+			return models.FilteredMetrics{Measurement: "jvm", Tags: map[string]string{"service_name": service}, Fields: map[string]interface{}{"value": value}, Group: "gauges"}
+		}
+
+		exporter.Write(context.Background(), []models.FilteredMetrics{metric("a", 1), metric("b", 2)}, nil, timestamp)
+		exporter.Write(context.Background(), []models.FilteredMetrics{metric("a", 3)}, nil, timestamp.Add(time.Minute))
+
+		Expect(scrape(exporter)).To(Equal("# TYPE jvm_value gauge\njvm_value{service_name=\"a\"} 3\n"))
+	})
+
+	It("Should keep missing series with their timestamp until they are stale", func() {
+		exporter := NewPrometheusExporter(PrometheusConfig{StaleAfter: 2 * time.Minute})
+		metric := func(service string, value float64) models.FilteredMetrics {
+			return models.FilteredMetrics{Measurement: "jvm", Tags: map[string]string{"service_name": service}, Fields: map[string]interface{}{"value": value}, Group: "gauges"}
+		}
+
+		exporter.Write(context.Background(), []models.FilteredMetrics{metric("a", 1), metric("b", 2)}, nil, timestamp)
+		exporter.Write(context.Background(), []models.FilteredMetrics{metric("a", 3)}, nil, timestamp.Add(time.Minute))
+
+		Expect(scrape(exporter)).To(Equal("# TYPE jvm_value gauge\n" +
+			"jvm_value{service_name=\"a\"} 3\n" +
+			"jvm_value{service_name=\"b\"} 2 1500000000000\n"))
+
+		exporter.Write(context.Background(), []models.FilteredMetrics{metric("a", 4)}, nil, timestamp.Add(2*time.Minute))
+
+		Expect(scrape(exporter)).To(Equal("# TYPE jvm_value gauge\njvm_value{service_name=\"a\"} 4\n"))
+	})
+})
@@ -0,0 +1,133 @@
+package metrics
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+const (
+	defaultPushgatewayJob = "metrics-fetcher"
+	// pushgatewayGroupLabel is the label grouping the pushed metrics next to the job
+	pushgatewayGroupLabel = "service_name"
+)
+
+// PushgatewayConfig is configuration of a sink pushing to Prometheus Pushgateway
+type PushgatewayConfig struct {
+	// Address of the Pushgateway, e.g. http://pushgateway:9091
+	Address string
+	// Job of the pushed groups, metrics-fetcher by default
+	Job      string
+	Username string
+	Password string
+	// PasswordFile is read when Password isn't set
+	PasswordFile string    `mapstructure:"password_file"`
+	TLS          TLSConfig `mapstructure:"tls"`
+	Timeout      time.Duration
+}
+
+// PushgatewaySink pushes metrics to Pushgateway in text format, names and labels are mapped the same way as by the
+// Prometheus exporter. Metrics are grouped by the job and the service_name, every push replaces all the metrics of
+// its group.
+type PushgatewaySink struct {
+	config PushgatewayConfig
+	client *http.Client
+}
+
+// NewPushgatewaySink creates a Pushgateway sink
+func NewPushgatewaySink(config PushgatewayConfig) (*PushgatewaySink, error) {
+	address, err := url.Parse(config.Address)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || len(address.Host) == 0 {
+		return nil, errors.Errorf("Invalid Pushgateway address: %s", config.Address)
+	}
+	config.Address = strings.TrimRight(config.Address, "/")
+	if len(config.Job) == 0 {
+		config.Job = defaultPushgatewayJob
+	}
+
+	if config.Password, err = resolveSecret(config.Password, config.PasswordFile); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := config.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PushgatewaySink{config: config, client: newHTTPClient(config.Timeout, tlsConfig)}, nil
+}
+
+// Write pushes metrics of every service as a separate group, failed pushes are returned as *WriteError
+func (s *PushgatewaySink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	groups := map[string][]prometheusSeries{}
+	for _, series := range prometheusSeriesOf(metrics, tags) {
+		service := ""
+		labels := []prometheusLabel{}
+		for _, label := range series.labels {
+			if label.name == pushgatewayGroupLabel {
+				service = label.value
+				continue
+			}
+			labels = append(labels, label)
+		}
+		series.labels = labels
+		groups[service] = append(groups[service], series)
+	}
+
+	services := make([]string, 0, len(groups))
+	for service := range groups {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	header := http.Header{}
+	header.Set("Content-Type", prometheusContentType)
+
+	failed := []*WriteError{}
+	for _, service := range services {
+		writer := httpWriter{
+			client:   s.client,
+			url:      s.groupURL(service),
+			username: s.config.Username,
+			password: s.config.Password,
+		}
+		if err := writer.send(ctx, "PUT", formatPrometheusText(groups[service]), header, len(groups[service])); err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	if err := mergeWriteErrors(failed); err != nil {
+		log.WithError(err).WithFields(log.Fields{"address": s.config.Address, "kind": err.Kind}).Error("Error pushing metrics to Pushgateway")
+		return err
+	}
+
+	return nil
+}
+
+// groupURL returns URL of the group of a service, metrics without service_name are grouped by the job only
+func (s *PushgatewaySink) groupURL(service string) string {
+	path := s.config.Address + "/metrics/job" + pushgatewayLabelPath(s.config.Job)
+	if len(service) != 0 {
+		path += "/" + pushgatewayGroupLabel + pushgatewayLabelPath(service)
+	}
+
+	return path
+}
+
+// pushgatewayLabelPath returns the value of a grouping label as a path segment, values with slashes are base64
+// encoded
+func pushgatewayLabelPath(value string) string {
+	if strings.Contains(value, "/") {
+		return "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+
+	return "/" + escapePathSegment(value)
+}
@@ -0,0 +1,88 @@
+package metrics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PushgatewaySink", func() {
+	var (
+		server *httptest.Server
+		pushed map[string]string
+	)
+	timestamp := time.Unix(1500000000, 0)
+
+	BeforeEach(func() {
+		pushed = map[string]string{}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Method).To(Equal("PUT"))
+			Expect(r.Header.Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+			body, err := ioutil.ReadAll(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			pushed[r.URL.EscapedPath()] = string(body)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("Should push metrics grouped by job and service", func() {
+		sink, err := NewPushgatewaySink(PushgatewayConfig{Address: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{
+				Measurement: "jvm",
+				Tags:        map[string]string{"service_name": "discussion", "metric_name": "heap"},
+				Fields:      map[string]interface{}{"value": 1.5},
+				Group:       "gauges",
+			},
+			{
+				Measurement: "requests",
+				Tags:        map[string]string{"service_name": "prod/discussion"},
+				Fields:      map[string]interface{}{"value": 10},
+				Group:       "timers",
+			},
+			{
+				Measurement: "services",
+				Fields:      map[string]interface{}{"count": 2},
+			},
+		}, map[string]string{"env": "prod"}, timestamp)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(pushed).To(Equal(map[string]string{
+			"/metrics/job/metrics-fetcher/service_name/discussion": "# TYPE jvm_value gauge\n" +
+				"jvm_value{env=\"prod\",metric_name=\"heap\"} 1.5\n",
+			"/metrics/job/metrics-fetcher/service_name@base64/cHJvZC9kaXNjdXNzaW9u": "# TYPE requests_value_total counter\n" +
+				"requests_value_total{env=\"prod\"} 10\n",
+			"/metrics/job/metrics-fetcher": "# TYPE services_count untyped\n" +
+				"services_count{env=\"prod\"} 2\n",
+		}))
+	})
+
+	It("Should return failed pushes", func() {
+		server.Close()
+		sink, err := NewPushgatewaySink(PushgatewayConfig{Address: server.URL, Job: "fetcher"})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{Measurement: "jvm", Tags: map[string]string{"service_name": "a"}, Fields: map[string]interface{}{"value": 1}},
+			{Measurement: "jvm", Tags: map[string]string{"service_name": "b"}, Fields: map[string]interface{}{"value": 1}},
+		}, nil, timestamp)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*WriteError).Kind).To(Equal(WriteErrorNetwork))
+		Expect(err.(*WriteError).Points).To(Equal(2))
+	})
+})
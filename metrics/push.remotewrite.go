@@ -0,0 +1,190 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+// RemoteWriteRequest is the WriteRequest message of Prometheus remote_write protocol
+type RemoteWriteRequest struct {
+	Timeseries []*RemoteTimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+}
+
+func (m *RemoteWriteRequest) Reset()         { *m = RemoteWriteRequest{} }
+func (m *RemoteWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*RemoteWriteRequest) ProtoMessage()    {}
+
+// RemoteTimeSeries is a series of remote_write request: its labels (__name__ included, sorted by name) and samples
+type RemoteTimeSeries struct {
+	Labels  []*RemoteLabel  `protobuf:"bytes,1,rep,name=labels" json:"labels,omitempty"`
+	Samples []*RemoteSample `protobuf:"bytes,2,rep,name=samples" json:"samples,omitempty"`
+}
+
+func (m *RemoteTimeSeries) Reset()         { *m = RemoteTimeSeries{} }
+func (m *RemoteTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*RemoteTimeSeries) ProtoMessage()    {}
+
+// RemoteLabel is a label of a remote_write series
+type RemoteLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+}
+
+func (m *RemoteLabel) Reset()         { *m = RemoteLabel{} }
+func (m *RemoteLabel) String() string { return proto.CompactTextString(m) }
+func (*RemoteLabel) ProtoMessage()    {}
+
+// RemoteSample is a sample of a remote_write series, timestamp is in milliseconds
+type RemoteSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (m *RemoteSample) Reset()         { *m = RemoteSample{} }
+func (m *RemoteSample) String() string { return proto.CompactTextString(m) }
+func (*RemoteSample) ProtoMessage()    {}
+
+// RemoteWriteConfig is configuration of a sink writing to Prometheus remote_write endpoint
+type RemoteWriteConfig struct {
+	// Address of the endpoint, e.g. http://prometheus:9090/api/v1/write
+	Address  string
+	Username string
+	Password string
+	// PasswordFile is read when Password isn't set
+	PasswordFile string `mapstructure:"password_file"`
+	// BearerToken is sent in the Authorization header, it can be read from BearerTokenFile
+	BearerToken     string    `mapstructure:"bearer_token"`
+	BearerTokenFile string    `mapstructure:"bearer_token_file"`
+	TLS             TLSConfig `mapstructure:"tls"`
+	Timeout         time.Duration
+	// BatchSize limits the number of series in a single request (5000 by default)
+	BatchSize int `mapstructure:"batch_size"`
+	// Retries of a batch failed with a network or server error, the backoff starts at RetryBackoff (1s by default)
+	// and doubles with every retry
+	Retries      int
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+}
+
+// RemoteWriteSink writes metrics to Prometheus remote_write endpoint as snappy compressed protobuf, names and labels
+// are mapped the same way as by the Prometheus exporter
+type RemoteWriteSink struct {
+	config RemoteWriteConfig
+	writer httpWriter
+	header http.Header
+}
+
+// NewRemoteWriteSink creates a remote_write sink
+func NewRemoteWriteSink(config RemoteWriteConfig) (*RemoteWriteSink, error) {
+	address, err := url.Parse(config.Address)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || len(address.Host) == 0 {
+		return nil, errors.Errorf("Invalid remote_write address: %s", config.Address)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultBatchSize
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = time.Second
+	}
+
+	if config.Password, err = resolveSecret(config.Password, config.PasswordFile); err != nil {
+		return nil, err
+	}
+	if config.BearerToken, err = resolveSecret(config.BearerToken, config.BearerTokenFile); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := config.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if len(config.BearerToken) != 0 {
+		header.Set("Authorization", "Bearer "+config.BearerToken)
+	}
+
+	return &RemoteWriteSink{
+		config: config,
+		writer: httpWriter{
+			client:   newHTTPClient(config.Timeout, tlsConfig),
+			url:      config.Address,
+			username: config.Username,
+			password: config.Password,
+		},
+		header: header,
+	}, nil
+}
+
+// Write sends metrics in batches, failed writes are returned as *WriteError
+func (s *RemoteWriteSink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	series := prometheusSeriesOf(metrics, tags)
+	failed := []*WriteError{}
+	for start := 0; start < len(series); start += s.config.BatchSize {
+		end := start + s.config.BatchSize
+		if end > len(series) {
+			end = len(series)
+		}
+
+		body, err := proto.Marshal(newRemoteWriteRequest(series[start:end], timestamp))
+		if err != nil {
+			return errors.Wrap(err, 0)
+		}
+		body = snappy.Encode(nil, body)
+
+		writeErr := withRetries(ctx, s.config.Retries, s.config.RetryBackoff, func() *WriteError {
+			return s.writer.send(ctx, "POST", body, s.header, end-start)
+		})
+		if writeErr != nil {
+			failed = append(failed, writeErr)
+		}
+	}
+
+	if err := mergeWriteErrors(failed); err != nil {
+		log.WithError(err).WithFields(log.Fields{"address": s.config.Address, "kind": err.Kind}).Error("Error sending metrics to remote_write endpoint")
+		return err
+	}
+
+	return nil
+}
+
+// newRemoteWriteRequest returns a request with a sample of every series
+func newRemoteWriteRequest(series []prometheusSeries, timestamp time.Time) *RemoteWriteRequest {
+	request := &RemoteWriteRequest{}
+	for _, s := range series {
+		// __name__ sorts before lowercase label names, but not before the uppercase ones
+		labels := []*RemoteLabel{}
+		named := false
+		for _, label := range s.labels {
+			if !named && label.name > "__name__" {
+				labels = append(labels, &RemoteLabel{Name: "__name__", Value: s.name})
+				named = true
+			}
+			labels = append(labels, &RemoteLabel{Name: label.name, Value: label.value})
+		}
+		if !named {
+			labels = append(labels, &RemoteLabel{Name: "__name__", Value: s.name})
+		}
+
+		request.Timeseries = append(request.Timeseries, &RemoteTimeSeries{
+			Labels:  labels,
+			Samples: []*RemoteSample{{Value: s.value, Timestamp: timestamp.UnixNano() / int64(time.Millisecond)}},
+		})
+	}
+
+	return request
+}
@@ -0,0 +1,125 @@
+package metrics_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RemoteWriteSink", func() {
+	var (
+		server   *httptest.Server
+		requests []*RemoteWriteRequest
+		headers  []http.Header
+		sizes    []int
+		status   int
+	)
+	timestamp := time.Unix(1500000000, 0)
+
+	BeforeEach(func() {
+		requests = nil
+		headers = nil
+		sizes = nil
+		status = http.StatusNoContent
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			body, err := ioutil.ReadAll(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			decoded, err := snappy.Decode(nil, body)
+			Expect(err).NotTo(HaveOccurred())
+			sizes = append(sizes, len(body))
+
+			request := &RemoteWriteRequest{}
+			Expect(proto.Unmarshal(decoded, request)).To(Succeed())
+			requests = append(requests, request)
+			headers = append(headers, r.Header)
+
+			w.WriteHeader(status)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("Should write snappy compressed protobuf", func() {
+		sink, err := NewRemoteWriteSink(RemoteWriteConfig{Address: server.URL + "/api/v1/write", BearerToken: "secret"})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{
+				Measurement: "requests",
+				Tags:        map[string]string{"service_name": "discussion", "Zone": "sjc"},
+				Fields:      map[string]interface{}{"value": int64(10), "m1_rate": 0.5, "service_id": "1"},
+				Group:       "meters",
+			},
+		}, map[string]string{"env": "prod"}, timestamp)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(headers[0].Get("Content-Encoding")).To(Equal("snappy"))
+		Expect(headers[0].Get("Content-Type")).To(Equal("application/x-protobuf"))
+		Expect(headers[0].Get("X-Prometheus-Remote-Write-Version")).To(Equal("0.1.0"))
+		Expect(headers[0].Get("Authorization")).To(Equal("Bearer secret"))
+
+		labels := func(name string) []*RemoteLabel {
+			return []*RemoteLabel{
+				{Name: "Zone", Value: "sjc"},
+				{Name: "__name__", Value: name},
+				{Name: "env", Value: "prod"},
+				{Name: "service_name", Value: "discussion"},
+			}
+		}
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Timeseries).To(Equal([]*RemoteTimeSeries{
+			{Labels: labels("requests_m1_rate"), Samples: []*RemoteSample{{Value: 0.5, Timestamp: 1500000000000}}},
+			{Labels: labels("requests_value_total"), Samples: []*RemoteSample{{Value: 10, Timestamp: 1500000000000}}},
+		}))
+	})
+
+	It("Should split series into batches", func() {
+		sink, err := NewRemoteWriteSink(RemoteWriteConfig{Address: server.URL, BatchSize: 2})
+		Expect(err).NotTo(HaveOccurred())
+
+		// a long repetitive label value is compressed
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{Measurement: "jvm", Tags: map[string]string{"path": strings.Repeat("a", 70000)}, Fields: map[string]interface{}{"a": 1, "b": 2, "c": 3}},
+		}, nil, timestamp)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[0].Timeseries).To(HaveLen(2))
+		Expect(requests[1].Timeseries).To(HaveLen(1))
+		Expect(requests[1].Timeseries[0].Labels[1].Value).To(HaveLen(70000))
+		Expect(sizes[1]).To(BeNumerically("<", 10000))
+	})
+
+	It("Should return failed writes", func() {
+		status = http.StatusUnauthorized
+		sink, err := NewRemoteWriteSink(RemoteWriteConfig{Address: server.URL})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sink.Write(context.Background(), []models.FilteredMetrics{
+			{Measurement: "jvm", Fields: map[string]interface{}{"value": 1}},
+		}, nil, timestamp)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*WriteError).Kind).To(Equal(WriteErrorAuth))
+		Expect(err.(*WriteError).Points).To(Equal(1))
+	})
+
+	It("Should reject invalid address", func() {
+		_, err := NewRemoteWriteSink(RemoteWriteConfig{Address: "prometheus:9090"})
+		Expect(err).To(HaveOccurred())
+	})
+})
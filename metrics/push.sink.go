@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// SinkStdout writes line protocol to the standard output
+	SinkStdout = "stdout"
+	// SinkInfluxDB writes to InfluxDB 1.x HTTP API
+	SinkInfluxDB = "influxdb"
+	// SinkInfluxDB2 writes to InfluxDB 2.x HTTP API
+	SinkInfluxDB2 = "influxdb2"
+	// SinkInfluxDBUDP writes to InfluxDB UDP service
+	SinkInfluxDBUDP = "influxdb_udp"
+	// SinkSocket writes line protocol to a socket, e.g. Telegraf socket_listener
+	SinkSocket = "socket"
+	// SinkGraphite writes to Graphite (Carbon) over TCP
+	SinkGraphite = "graphite"
+	// SinkRemoteWrite writes to Prometheus remote_write endpoint
+	SinkRemoteWrite = "prometheus_remote_write"
+	// SinkPushgateway pushes to Prometheus Pushgateway
+	SinkPushgateway = "pushgateway"
+)
+
+// Sink sends filtered metrics to a backend
+type Sink interface {
+	Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error
+}
+
+// SinkConfig is configuration of a single sink: its type, optional name (type by default) and type specific
+// options
+type SinkConfig map[string]interface{}
+
+// sinkFactories creates sinks by their type from the type specific options
+var sinkFactories = map[string]func(options map[string]interface{}) (Sink, error){
+	SinkStdout: func(options map[string]interface{}) (Sink, error) {
+		config := struct{ Precision string }{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		return NewStdoutSink(nil, config.Precision)
+	},
+	SinkInfluxDB: func(options map[string]interface{}) (Sink, error) {
+		config := InfluxConfig{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		if len(config.Address) == 0 {
+			return nil, errors.Errorf("Missing address of InfluxDB sink")
+		}
+		return NewInfluxSink(config)
+	},
+	SinkInfluxDB2: func(options map[string]interface{}) (Sink, error) {
+		config := Influx2Config{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		return NewInflux2Sink(config)
+	},
+	SinkInfluxDBUDP: func(options map[string]interface{}) (Sink, error) {
+		config := SocketConfig{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		if !strings.Contains(config.Address, "://") {
+			config.Address = "udp://" + config.Address
+		}
+		return NewSocketSink(config)
+	},
+	SinkSocket: func(options map[string]interface{}) (Sink, error) {
+		config := SocketConfig{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		return NewSocketSink(config)
+	},
+	SinkGraphite: func(options map[string]interface{}) (Sink, error) {
+		config := GraphiteConfig{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		return NewGraphiteSink(config)
+	},
+	SinkRemoteWrite: func(options map[string]interface{}) (Sink, error) {
+		config := RemoteWriteConfig{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		return NewRemoteWriteSink(config)
+	},
+	SinkPushgateway: func(options map[string]interface{}) (Sink, error) {
+		config := PushgatewayConfig{}
+		if err := decodeSinkOptions(options, &config); err != nil {
+			return nil, err
+		}
+		return NewPushgatewaySink(config)
+	},
+}
+
+func decodeSinkOptions(options map[string]interface{}, result interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		WeaklyTypedInput: true,
+		Result:           result,
+	})
+	if err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	if err = decoder.Decode(options); err != nil {
+		return errors.WrapPrefix(err, "Invalid sink options", 0)
+	}
+
+	return nil
+}
+
+// SinkStats holds statistics of writes to a sink
+type SinkStats struct {
+	Writes   int
+	Failures int
+	// Points is the number of metrics successfully written
+	Points       int
+	LastError    error
+	LastDuration time.Duration
+}
+
+// namedSink is a sink with its name and statistics
+type namedSink struct {
+	name  string
+	sink  Sink
+	stats SinkStats
+}
+
+// Sinks writes metrics to multiple sinks in parallel
+type Sinks struct {
+	sinks []*namedSink
+	mutex sync.Mutex
+}
+
+// NewSinks creates sinks from configuration
+func NewSinks(configs []SinkConfig) (*Sinks, error) {
+	sinks := &Sinks{}
+	for _, config := range configs {
+		options := map[string]interface{}{}
+		for k, v := range config {
+			options[k] = v
+		}
+
+		sinkType, _ := options["type"].(string)
+		name, _ := options["name"].(string)
+		delete(options, "type")
+		delete(options, "name")
+
+		factory, ok := sinkFactories[sinkType]
+		if !ok {
+			return nil, errors.Errorf("Unknown sink type: %s", sinkType)
+		}
+
+		sink, err := factory(options)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "Invalid sink "+sinkType, 0)
+		}
+
+		if len(name) == 0 {
+			name = sinkType
+		}
+		if err = sinks.Add(name, sink); err != nil {
+			return nil, err
+		}
+	}
+
+	return sinks, nil
+}
+
+// Add adds a sink with a unique name
+func (s *Sinks) Add(name string, sink Sink) error {
+	for _, existing := range s.sinks {
+		if existing.name == name {
+			return errors.Errorf("Duplicated sink name: %s", name)
+		}
+	}
+
+	s.sinks = append(s.sinks, &namedSink{name: name, sink: sink})
+
+	return nil
+}
+
+// Len returns number of the sinks
+func (s *Sinks) Len() int {
+	return len(s.sinks)
+}
+
+// SinkErrors holds errors of failed sinks by their names
+type SinkErrors map[string]error
+
+func (e SinkErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, len(names))
+	for i, name := range names {
+		messages[i] = name + ": " + e[name].Error()
+	}
+
+	return "Error writing to sinks: " + strings.Join(messages, "; ")
+}
+
+// Write sends metrics to all the sinks in parallel, SinkErrors is returned when any of them failed
+func (s *Sinks) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	failed := SinkErrors{}
+	wg := sync.WaitGroup{}
+
+	for _, sink := range s.sinks {
+		wg.Add(1)
+		go func(sink *namedSink) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := sink.sink.Write(ctx, metrics, tags, timestamp)
+			duration := time.Since(start)
+
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+
+			sink.stats.Writes++
+			sink.stats.LastDuration = duration
+			sink.stats.LastError = err
+			entry := log.WithFields(log.Fields{"sink": sink.name, "duration": duration})
+			if err != nil {
+				sink.stats.Failures++
+				failed[sink.name] = err
+				entry.WithError(err).Error("Error writing metrics to sink")
+				return
+			}
+			sink.stats.Points += len(metrics)
+			entry.WithField("points", len(metrics)).Debug("Metrics written to sink")
+		}(sink)
+	}
+	wg.Wait()
+
+	if len(failed) != 0 {
+		return failed
+	}
+
+	return nil
+}
+
+// Stats returns statistics of all the sinks by their names
+func (s *Sinks) Stats() map[string]SinkStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := map[string]SinkStats{}
+	for _, sink := range s.sinks {
+		stats[sink.name] = sink.stats
+	}
+
+	return stats
+}
@@ -0,0 +1,116 @@
+package metrics_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+// fakeSink records written metrics and fails with the given error
+type fakeSink struct {
+	written chan []models.FilteredMetrics
+	err     error
+}
+
+func (s *fakeSink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	s.written <- metrics
+	return s.err
+}
+
+var _ = Describe("Sinks", func() {
+	timestamp := time.Now()
+	filtered := []models.FilteredMetrics{
+		{
+			Measurement: "test-measurement",
+			Tags:        map[string]string{"service_name": "test-service"},
+			Fields:      map[string]interface{}{"value": 1.5},
+		},
+	}
+
+	It("Should create sinks from configuration", func() {
+		server := ghttp.NewServer()
+		defer server.Close()
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/write", "db=metrics&precision=ns&rp=default"),
+			ghttp.RespondWith(http.StatusNoContent, ""),
+		))
+
+		sinks, err := NewSinks([]SinkConfig{
+			{"type": "influxdb", "address": server.URL(), "database": "metrics"},
+			{"type": "influxdb", "name": "backup", "address": server.URL(), "database": "metrics"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sinks.Len()).To(Equal(2))
+		server.AppendHandlers(server.GetHandler(0))
+
+		Expect(sinks.Write(context.Background(), filtered, nil, timestamp)).To(Succeed())
+		Expect(server.ReceivedRequests()).To(HaveLen(2))
+		Expect(sinks.Stats()["backup"].Points).To(Equal(1))
+	})
+
+	It("Should create InfluxDB UDP sinks with and without the scheme", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		address := listener.LocalAddr().String()
+
+		sinks, err := NewSinks([]SinkConfig{
+			{"type": "influxdb_udp", "address": address},
+			{"type": "influxdb_udp", "name": "scheme", "address": "udp://" + address},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sinks.Write(context.Background(), filtered, nil, timestamp)).To(Succeed())
+
+		buffer := make([]byte, 1024)
+		for i := 0; i < 2; i++ {
+			listener.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := listener.ReadFrom(buffer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(buffer[:n])).To(HavePrefix("test-measurement,service_name=test-service"))
+		}
+	})
+
+	It("Should reject invalid configuration", func() {
+		_, err := NewSinks([]SinkConfig{{"type": "carrier-pigeon"}})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewSinks([]SinkConfig{{"type": "influxdb"}})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewSinks([]SinkConfig{{"type": "stdout"}, {"type": "stdout"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should write to all the sinks and report failures separately", func() {
+		healthy := &fakeSink{written: make(chan []models.FilteredMetrics, 1)}
+		broken := &fakeSink{written: make(chan []models.FilteredMetrics, 1), err: errors.New("connection refused")}
+		sinks := &Sinks{}
+		Expect(sinks.Add("healthy", healthy)).To(Succeed())
+		Expect(sinks.Add("broken", broken)).To(Succeed())
+
+		err := sinks.Write(context.Background(), filtered, nil, timestamp)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err).To(BeAssignableToTypeOf(SinkErrors{}))
+		Expect(err.(SinkErrors)).To(HaveKey("broken"))
+		Expect(err.(SinkErrors)).NotTo(HaveKey("healthy"))
+		Expect(<-healthy.written).To(Equal(filtered))
+		Expect(<-broken.written).To(Equal(filtered))
+
+		stats := sinks.Stats()
+		Expect(stats["healthy"].Writes).To(Equal(1))
+		Expect(stats["healthy"].Failures).To(Equal(0))
+		Expect(stats["healthy"].Points).To(Equal(1))
+		Expect(stats["broken"].Failures).To(Equal(1))
+		Expect(stats["broken"].LastError).To(MatchError("connection refused"))
+	})
+})
@@ -0,0 +1,192 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/Wikia/metrics-fetcher/models"
+	"github.com/go-errors/errors"
+)
+
+const (
+	// defaultMaxPacketSize fits a UDP payload into a single Ethernet frame
+	defaultMaxPacketSize = 1400
+	// defaultMaxUnixPacketSize is the largest UDP payload, unixgram sockets are local so they aren't fragmented
+	defaultMaxUnixPacketSize = 65507
+)
+
+// SocketConfig is configuration of a sink writing line protocol to a socket
+type SocketConfig struct {
+	// Address with the network: tcp://localhost:8094, udp://localhost:8089, unix:///var/run/telegraf.sock or
+	// unixgram:///var/run/telegraf.sock
+	Address string
+	// MaxPacketSize (bytes) of datagrams, 1400 by default for udp and 65507 for unixgram
+	MaxPacketSize int `mapstructure:"max_packet_size"`
+	Timeout       time.Duration
+	// Precision of the timestamps: ns (default), us, ms or s
+	Precision string
+}
+
+// SocketSink writes metrics in line protocol to a socket: InfluxDB UDP service or Telegraf socket_listener
+type SocketSink struct {
+	config  SocketConfig
+	encoder LineEncoder
+	network string
+	address string
+}
+
+// NewSocketSink creates a socket sink
+func NewSocketSink(config SocketConfig) (*SocketSink, error) {
+	parts := strings.SplitN(config.Address, "://", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return nil, errors.Errorf("Invalid socket address: %s", config.Address)
+	}
+
+	switch parts[0] {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix", "unixgram":
+	default:
+		return nil, errors.Errorf("Unsupported socket network: %s", parts[0])
+	}
+
+	if config.MaxPacketSize <= 0 {
+		config.MaxPacketSize = defaultMaxPacketSize
+		if parts[0] == "unixgram" {
+			config.MaxPacketSize = defaultMaxUnixPacketSize
+		}
+	}
+
+	encoder, err := NewLineEncoder(config.Precision)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SocketSink{config: config, encoder: encoder, network: parts[0], address: parts[1]}, nil
+}
+
+// datagram tells whether the network sends separate packets
+func (s *SocketSink) datagram() bool {
+	return strings.HasPrefix(s.network, "udp") || s.network == "unixgram"
+}
+
+// Write sends metrics to the socket, datagrams are split to fit the maximum packet size. Failed writes are
+// returned as *WriteError.
+func (s *SocketSink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	var lines []string
+	if s.datagram() {
+		lines = s.datagramLines(metrics, tags, timestamp)
+	} else {
+		lines = s.encoder.EncodeAll(metrics, tags, timestamp)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	dialer := net.Dialer{Timeout: s.config.Timeout}
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return NewWriteError(err, len(lines))
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	} else if s.config.Timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+	}
+
+	if !s.datagram() {
+		if _, err = conn.Write([]byte(strings.Join(lines, ""))); err != nil {
+			return NewWriteError(err, len(lines))
+		}
+		return nil
+	}
+
+	packets, dropped := splitPackets(lines, s.config.MaxPacketSize)
+	for _, packet := range packets {
+		if _, err = conn.Write(packet); err != nil {
+			return NewWriteError(err, len(lines))
+		}
+	}
+
+	if dropped != 0 {
+		log.WithFields(log.Fields{"address": s.config.Address, "dropped": dropped}).Warn("Points larger than the maximum packet size dropped")
+		return &WriteError{
+			Kind:    WriteErrorPartial,
+			Message: "points larger than the maximum packet size dropped",
+			Points:  len(lines),
+			Dropped: dropped,
+		}
+	}
+
+	return nil
+}
+
+// datagramLines encodes metrics the same way as EncodeAll, but points larger than the maximum packet size are split
+// by their fields into several lines of the same series
+func (s *SocketSink) datagramLines(metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) []string {
+	lines := []string{}
+	for _, metric := range metrics {
+		line, err := s.encoder.Encode(metric, tags, timestamp)
+		if err != nil {
+			log.WithError(err).WithField("measurement", metric.Measurement).Warn("Skipping metric")
+			continue
+		}
+		if len(line) <= s.config.MaxPacketSize || len(metric.Fields) < 2 {
+			lines = append(lines, line)
+			continue
+		}
+
+		// fields are added to the line while it fits, a field which doesn't fit even alone is left to splitPackets
+		part := metric
+		part.Fields = map[string]interface{}{}
+		line = ""
+		for _, field := range sortedFieldKeys(metric.Fields) {
+			part.Fields[field] = metric.Fields[field]
+			next, err := s.encoder.Encode(part, tags, timestamp)
+			if err != nil {
+				// the field can't be encoded (e.g. NaN)
+				delete(part.Fields, field)
+				continue
+			}
+			if len(next) > s.config.MaxPacketSize && len(line) != 0 {
+				lines = append(lines, line)
+				part.Fields = map[string]interface{}{field: metric.Fields[field]}
+				next, _ = s.encoder.Encode(part, tags, timestamp)
+			}
+			line = next
+		}
+		if len(line) != 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// splitPackets joins lines into packets of at most maxSize bytes, lines larger than that are dropped
+func splitPackets(lines []string, maxSize int) ([][]byte, int) {
+	packets := [][]byte{}
+	dropped := 0
+
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if len(line) > maxSize {
+			dropped++
+			continue
+		}
+		if packet.Len()+len(line) > maxSize {
+			packets = append(packets, append([]byte{}, packet.Bytes()...))
+			packet.Reset()
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() != 0 {
+		packets = append(packets, packet.Bytes())
+	}
+
+	return packets, dropped
+}
@@ -0,0 +1,168 @@
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/Wikia/metrics-fetcher/metrics"
+	"github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SocketSink", func() {
+	timestamp := time.Unix(1500000000, 0)
+	metrics := func(count int) []models.FilteredMetrics {
+		result := []models.FilteredMetrics{}
+		for i := 0; i < count; i++ {
+			result = append(result, models.FilteredMetrics{
+				Measurement: "test-measurement",
+				Tags:        map[string]string{"metric_name": fmt.Sprintf("metric_%d", i)},
+				Fields:      map[string]interface{}{"value": float64(i)},
+			})
+		}
+		return result
+	}
+
+	// accept reads everything written to the first connection of a stream listener
+	accept := func(listener net.Listener) chan string {
+		received := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			content, _ := ioutil.ReadAll(conn)
+			received <- string(content)
+		}()
+		return received
+	}
+
+	It("Should split datagrams to fit the maximum packet size", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		sink, err := NewSocketSink(SocketConfig{Address: "udp://" + listener.LocalAddr().String(), MaxPacketSize: 140})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(sink.Write(context.Background(), metrics(5), nil, timestamp)).To(Succeed())
+
+		lines := 0
+		buffer := make([]byte, 1024)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		for lines < 5 {
+			n, _, err := listener.ReadFrom(buffer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(BeNumerically("<=", 140))
+			Expect(string(buffer[:n])).To(HaveSuffix("\n"))
+			lines += strings.Count(string(buffer[:n]), "\n")
+		}
+		Expect(lines).To(Equal(5))
+	})
+
+	It("Should split points larger than the maximum packet size by their fields", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		sink, err := NewSocketSink(SocketConfig{Address: "udp://" + listener.LocalAddr().String(), MaxPacketSize: 100})
+		Expect(err).NotTo(HaveOccurred())
+		timer := models.FilteredMetrics{
+			Measurement: "test-measurement",
+			Tags:        map[string]string{"metric_name": "requests"},
+			Fields:      map[string]interface{}{"value": int64(10), "m1_rate": 1.5, "p50": 0.25, "p99": 0.75, "rate": 2.0, "service_id": "task-1"},
+		}
+
+		Expect(sink.Write(context.Background(), []models.FilteredMetrics{timer}, nil, timestamp)).To(Succeed())
+
+		received := ""
+		buffer := make([]byte, 1024)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		for strings.Count(received, "=") < 7 {
+			n, _, err := listener.ReadFrom(buffer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).To(BeNumerically("<=", 100))
+			received += string(buffer[:n])
+		}
+		Expect(strings.Count(received, "\n")).To(BeNumerically(">", 1))
+		for _, field := range []string{"m1_rate=1.5", "p50=0.25", "p99=0.75", "rate=2", `service_id="task-1"`, "value=10i"} {
+			Expect(received).To(ContainSubstring(field))
+		}
+	})
+
+	It("Should drop points larger than the maximum packet size", func() {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+
+		sink, err := NewSocketSink(SocketConfig{Address: "udp://" + listener.LocalAddr().String(), MaxPacketSize: 10})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sink.Write(context.Background(), metrics(2), nil, timestamp)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*WriteError).Kind).To(Equal(WriteErrorPartial))
+		Expect(err.(*WriteError).Dropped).To(Equal(2))
+	})
+
+	It("Should write to a TCP socket", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		received := accept(listener)
+
+		sink, err := NewSocketSink(SocketConfig{Address: "tcp://" + listener.Addr().String()})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(sink.Write(context.Background(), metrics(2), map[string]string{"foo": "bar"}, timestamp)).To(Succeed())
+
+		Eventually(received).Should(Receive(Equal(
+			"test-measurement,foo=bar,metric_name=metric_0 value=0 1500000000000000000\n" +
+				"test-measurement,foo=bar,metric_name=metric_1 value=1 1500000000000000000\n",
+		)))
+	})
+
+	It("Should write to a unix socket", func() {
+		dir, err := ioutil.TempDir("", "socket")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "telegraf.sock")
+		listener, err := net.Listen("unix", path)
+		Expect(err).NotTo(HaveOccurred())
+		defer listener.Close()
+		received := accept(listener)
+
+		sink, err := NewSocketSink(SocketConfig{Address: "unix://" + path})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(sink.Write(context.Background(), metrics(1), nil, timestamp)).To(Succeed())
+
+		Eventually(received).Should(Receive(Equal("test-measurement,metric_name=metric_0 value=0 1500000000000000000\n")))
+	})
+
+	It("Should report network errors", func() {
+		sink, err := NewSocketSink(SocketConfig{Address: "tcp://127.0.0.1:1"})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = sink.Write(context.Background(), metrics(1), nil, timestamp)
+
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*WriteError).Kind).To(Equal(WriteErrorNetwork))
+	})
+
+	It("Should reject invalid addresses", func() {
+		for _, address := range []string{"localhost:8094", "http://localhost:8094", "udp://"} {
+			_, err := NewSocketSink(SocketConfig{Address: address})
+			Expect(err).To(HaveOccurred(), address)
+		}
+	})
+})
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+)
+
+const spoolExtension = ".lp"
+
+// Spool keeps batches of points that couldn't be written on disk (in line protocol, a file per batch) until they
+// are replayed
+type Spool struct {
+	dir string
+	// maxSize (bytes) of all the spooled batches, the oldest batches are dropped over it, 0 means no limit
+	maxSize  int64
+	sequence int
+	mutex    sync.Mutex
+}
+
+// SpooledBatch is a batch of lines read from the spool
+type SpooledBatch struct {
+	Name  string
+	Lines []string
+}
+
+// NewSpool creates a spool in the directory, the directory is created with the first stored batch
+func NewSpool(dir string, maxSize int64) *Spool {
+	return &Spool{dir: dir, maxSize: maxSize}
+}
+
+// Store writes a batch of lines to the spool and drops the oldest batches over the size limit
+func (s *Spool) Store(lines []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return errors.Wrap(err, 0)
+	}
+
+	// names sort by the time the batches were spooled
+	s.sequence++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), s.sequence, spoolExtension)
+	temp := filepath.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(temp, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return errors.Wrap(err, 0)
+	}
+	if err := os.Rename(temp, filepath.Join(s.dir, name)); err != nil {
+		os.Remove(temp)
+		return errors.Wrap(err, 0)
+	}
+
+	return s.truncate()
+}
+
+// truncate drops the oldest batches over the size limit
+func (s *Spool) truncate() error {
+	if s.maxSize <= 0 {
+		return nil
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, file := range files {
+		size += file.Size()
+	}
+
+	for _, file := range files {
+		if size <= s.maxSize {
+			break
+		}
+		if err = os.Remove(filepath.Join(s.dir, file.Name())); err != nil {
+			return errors.Wrap(err, 0)
+		}
+		size -= file.Size()
+		log.WithFields(log.Fields{"spool": s.dir, "batch": file.Name()}).Warn("Spooled batch dropped over the spool size limit")
+	}
+
+	return nil
+}
+
+// files returns spooled batches, the oldest first (ReadDir returns the entries sorted by their names)
+func (s *Spool) files() ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, 0)
+	}
+
+	files := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasSuffix(entry.Name(), spoolExtension) && !strings.HasPrefix(entry.Name(), ".") {
+			files = append(files, entry)
+		}
+	}
+
+	return files, nil
+}
+
+// Batches reads all the spooled batches, the oldest first
+func (s *Spool) Batches() ([]SpooledBatch, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+
+	batches := []SpooledBatch{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(s.dir, file.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, 0)
+		}
+
+		batch := SpooledBatch{Name: file.Name()}
+		for _, line := range strings.SplitAfter(string(content), "\n") {
+			if len(line) != 0 {
+				batch.Lines = append(batch.Lines, line)
+			}
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, nil
+}
+
+// Remove deletes a replayed batch from the spool
+func (s *Spool) Remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, 0)
+	}
+
+	return nil
+}
@@ -1,75 +1,60 @@
 package metrics
 
 import (
-	"fmt"
+	"context"
 	"io"
-	"strings"
+	"os"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/Wikia/metrics-fetcher/models"
 	"github.com/pkg/errors"
 )
 
-// OutputMetrics to STDOUT
-func OutputMetrics(filteredMetrics []models.FilteredMetrics, extraTags map[string]string, writer io.Writer) error {
-	log.Info("outputting metrics")
-	for _, metric := range filteredMetrics {
-		if len(metric.Fields) == 0 {
-			return errors.Errorf("no fields in metric")
-		}
+// StdoutSink writes metrics in line protocol to a writer (standard output by default)
+type StdoutSink struct {
+	writer  io.Writer
+	encoder LineEncoder
+	mutex   sync.Mutex
+}
 
-		tagKeysAndValues := make([]string, len(metric.Tags)+len(extraTags))
-		i := 0
-		for tagKey, tagValue := range metric.Tags {
-			tagKeysAndValues[i] = fmt.Sprintf("%s=%s", escapeSpecialChars(tagKey), escapeSpecialChars(tagValue))
-			i++
-		}
+// NewStdoutSink creates a sink writing to the writer with timestamps in the given precision (ns by default), nil
+// writer means standard output
+func NewStdoutSink(writer io.Writer, precision string) (*StdoutSink, error) {
+	if writer == nil {
+		writer = os.Stdout
+	}
 
-		for tagKey, tagValue := range extraTags {
-			tagKeysAndValues[i] = fmt.Sprintf("%s=%s", escapeSpecialChars(tagKey), escapeSpecialChars(tagValue))
-			i++
-		}
-		tags := strings.Join(tagKeysAndValues, ",")
+	encoder, err := NewLineEncoder(precision)
+	if err != nil {
+		return nil, err
+	}
 
-		fieldKeysAndValues := make([]string, len(metric.Fields))
-		j := 0
-		for fieldKey, fieldValue := range metric.Fields {
-			var valueFormat string
-			switch fieldValue.(type) {
-			case string:
-				valueFormat = "%q" //escapes quotes and puts into quotes
-			case uint, uint8, uint16, uint32, uint64, int, int8, int16, int32, int64:
-				valueFormat = "%d"
-			case float32, float64:
-				valueFormat = "%g"
-			case bool:
-				valueFormat = "%t"
-			default:
-				valueFormat = "%v"
-			}
+	return &StdoutSink{writer: writer, encoder: encoder}, nil
+}
 
-			fieldKeysAndValues[j] = fmt.Sprintf(fmt.Sprintf("%%s=%s", valueFormat), escapeSpecialChars(fieldKey), fieldValue)
-			j++
-		}
-		fields := strings.Join(fieldKeysAndValues, ",")
-		if len(tags) == 0 {
-			fmt.Fprint(writer, fmt.Sprintf("%s %s\n", escapeMeasurementName(metric.Measurement), fields))
-		} else {
-			fmt.Fprint(writer, fmt.Sprintf("%s,%s %s\n", escapeMeasurementName(metric.Measurement), tags, fields))
-		}
-	}
-	return nil
+// Write outputs metrics in line protocol
+func (s *StdoutSink) Write(ctx context.Context, metrics []models.FilteredMetrics, tags map[string]string, timestamp time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return writeLines(s.encoder.EncodeAll(metrics, tags, timestamp), s.writer)
 }
 
-func escapeSpecialChars(value string) string {
-	value = strings.Replace(value, " ", "\\ ", -1)
-	value = strings.Replace(value, ",", "\\,", -1)
-	value = strings.Replace(value, "=", "\\=", -1)
-	return value
+// OutputMetrics to STDOUT, without timestamps
+func OutputMetrics(filteredMetrics []models.FilteredMetrics, extraTags map[string]string, writer io.Writer) error {
+	log.Info("outputting metrics")
+
+	return writeLines(LineEncoder{}.EncodeAll(filteredMetrics, extraTags, time.Time{}), writer)
 }
 
-func escapeMeasurementName(value string) string {
-	value = strings.Replace(value, " ", "\\ ", -1)
-	value = strings.Replace(value, ",", "\\,", -1)
-	return value
+func writeLines(lines []string, writer io.Writer) error {
+	for _, line := range lines {
+		if _, err := io.WriteString(writer, line); err != nil {
+			return errors.Wrap(err, "error writing metrics")
+		}
+	}
+
+	return nil
 }
@@ -35,14 +35,15 @@ func TestShouldWriteToOutputWhenNotEmptyFilters(t *testing.T) {
 	testObj.AssertExpectations(t)
 }
 
-func TestShouldErrorWhenNoFields(t *testing.T) {
+func TestShouldSkipMetricsWithoutFields(t *testing.T) {
 	//given
 	testObj := new(MockedWriter)
 	metric := metric(map[string]string{"exampleTag": "exampleTagValue"}, map[string]interface{}{})
 	//when
 	err := OutputMetrics([]models.FilteredMetrics{metric}, map[string]string{}, testObj)
 	//then
-	assert.NotNil(t, err)
+	assert.Nil(t, err)
+	testObj.AssertNotCalled(t, "Write")
 }
 
 func TestShouldHandleNoTags(t *testing.T) {
@@ -1,8 +1,13 @@
 package metrics_test
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/Wikia/metrics-fetcher/metrics"
@@ -35,7 +40,7 @@ var _ = Describe("Push", func() {
 			server.AppendHandlers(
 				ghttp.CombineHandlers(
 					ghttp.VerifyBasicAuth(testUsername, testPassword),
-					ghttp.VerifyRequest("POST", "/write", "consistency=&db=services&precision=ns&rp=default"),
+					ghttp.VerifyRequest("POST", "/write", "db=services&precision=ns&rp=default"),
 					ghttp.VerifyBody([]byte(fmt.Sprintf("test-measurement,foo=bar,host=localhost,metric_name=test_metric,service_name=test-service service_id=\"1234-5678-90\",value=123.45566 %d\nmetric_graphs,foo=bar,metric_name=test_metric,service_name=test-service max=2568.4762,med=733.68,min=12.345 %d\n", timestamp.UnixNano(), timestamp.UnixNano()))),
 					ghttp.RespondWith(http.StatusOK, "OK"),
 				),
@@ -76,4 +81,183 @@ var _ = Describe("Push", func() {
 			Expect(server.ReceivedRequests()).To(HaveLen(1))
 		})
 	})
+
+	Describe("SendMetrics() failures", func() {
+		metrics := []models.FilteredMetrics{
+			{Measurement: "first", Tags: map[string]string{"service_name": "test-service"}, Fields: map[string]interface{}{"value": 1.0}},
+			{Measurement: "second", Tags: map[string]string{"service_name": "test-service"}, Fields: map[string]interface{}{"value": 2.0}},
+		}
+
+		send := func(address string) *WriteError {
+			err := SendMetrics(address, "services", "default", testUsername, testPassword, metrics, nil, time.Now())
+			Expect(err).To(HaveOccurred())
+			Expect(err).To(BeAssignableToTypeOf(&WriteError{}))
+			return err.(*WriteError)
+		}
+
+		It("Should classify errors", func() {
+			for _, response := range []struct {
+				status int
+				body   string
+				kind   WriteErrorKind
+			}{
+				{http.StatusUnauthorized, `{"error":"authorization failed"}`, WriteErrorAuth},
+				{http.StatusNotFound, `{"error":"database not found: \"services\""}`, WriteErrorDatabaseNotFound},
+				{http.StatusBadRequest, `{"error":"field type conflict: input field \"value\" on measurement \"first\" is type integer, already exists as type float"}`, WriteErrorFieldTypeConflict},
+				{http.StatusBadGateway, `<html>Bad Gateway</html>`, WriteErrorUnknown},
+			} {
+				server.AppendHandlers(ghttp.RespondWith(response.status, response.body))
+
+				err := send(server.URL())
+
+				Expect(err.Kind).To(Equal(response.kind), response.body)
+				Expect(err.Points).To(Equal(2))
+				Expect(err.DroppedRatio()).To(Equal(1.0))
+			}
+		})
+
+		It("Should report points dropped by a partial write", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusBadRequest, `{"error":"partial write: field type conflict: input field \"value\" on measurement \"first\" is type integer, already exists as type float dropped=1"}`))
+
+			err := send(server.URL())
+
+			Expect(err.Kind).To(Equal(WriteErrorPartial))
+			Expect(err.Dropped).To(Equal(1))
+			Expect(err.DroppedRatio()).To(Equal(0.5))
+			Expect(err.Error()).To(HavePrefix("Error writing 2 points (partial_write): partial write"))
+		})
+
+		It("Should report network errors", func() {
+			address := server.URL()
+			server.Close()
+
+			Expect(send(address).Kind).To(Equal(WriteErrorNetwork))
+		})
+	})
+
+	Describe("InfluxSink", func() {
+		var spoolDir string
+
+		metrics := func(count int) []models.FilteredMetrics {
+			result := []models.FilteredMetrics{}
+			for i := 0; i < count; i++ {
+				result = append(result, models.FilteredMetrics{
+					Measurement: "test-measurement",
+					Tags:        map[string]string{"metric_name": fmt.Sprintf("metric_%d", i)},
+					Fields:      map[string]interface{}{"value": float64(i)},
+				})
+			}
+			return result
+		}
+
+		newSink := func(config InfluxConfig) *InfluxSink {
+			sink, err := NewInfluxSink(config)
+			Expect(err).NotTo(HaveOccurred())
+			return sink
+		}
+
+		// respond records bodies of the write requests and responds with the statuses in order (204 when exhausted)
+		respond := func(bodies *[]string, statuses ...int) {
+			mutex := sync.Mutex{}
+			server.RouteToHandler("POST", "/write", func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				mutex.Lock()
+				defer mutex.Unlock()
+				*bodies = append(*bodies, string(body))
+				status := http.StatusNoContent
+				if len(statuses) != 0 {
+					status, statuses = statuses[0], statuses[1:]
+				}
+				w.WriteHeader(status)
+			})
+		}
+
+		BeforeEach(func() {
+			var err error
+			spoolDir, err = ioutil.TempDir("", "spool")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(spoolDir)
+		})
+
+		It("Should write batches in parallel", func() {
+			bodies := []string{}
+			respond(&bodies)
+			sink := newSink(InfluxConfig{Address: server.URL(), BatchSize: 2, Concurrency: 2})
+
+			Expect(sink.Write(context.Background(), metrics(5), nil, time.Now())).To(Succeed())
+
+			Expect(bodies).To(HaveLen(3))
+			Expect(strings.Count(strings.Join(bodies, ""), "\n")).To(Equal(5))
+		})
+
+		It("Should retry temporary failures", func() {
+			bodies := []string{}
+			respond(&bodies, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+			sink := newSink(InfluxConfig{Address: server.URL(), Retries: 2, RetryBackoff: time.Millisecond})
+
+			Expect(sink.Write(context.Background(), metrics(1), nil, time.Now())).To(Succeed())
+			Expect(bodies).To(HaveLen(3))
+		})
+
+		It("Should not retry rejected points", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusBadRequest, `{"error":"field type conflict: input field \"value\" on measurement \"test-measurement\" is type float, already exists as type integer"}`))
+			sink := newSink(InfluxConfig{Address: server.URL(), Retries: 2, RetryBackoff: time.Millisecond, SpoolDir: spoolDir})
+
+			err := sink.Write(context.Background(), metrics(1), nil, time.Now())
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*WriteError).Kind).To(Equal(WriteErrorFieldTypeConflict))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+			Expect(NewSpool(spoolDir, 0).Batches()).To(BeEmpty())
+		})
+
+		It("Should spool failed batches and replay them", func() {
+			bodies := []string{}
+			respond(&bodies, http.StatusServiceUnavailable)
+			sink := newSink(InfluxConfig{Address: server.URL(), SpoolDir: spoolDir})
+
+			err := sink.Write(context.Background(), metrics(1), nil, time.Now())
+
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*WriteError).Kind).To(Equal(WriteErrorUnknown))
+			Expect(NewSpool(spoolDir, 0).Batches()).To(HaveLen(1))
+
+			Expect(sink.Write(context.Background(), metrics(2)[1:], nil, time.Now())).To(Succeed())
+
+			Expect(bodies).To(HaveLen(3))
+			Expect(bodies[1]).To(Equal(bodies[0]))
+			Expect(bodies[2]).To(ContainSubstring("metric_1"))
+			Expect(NewSpool(spoolDir, 0).Batches()).To(BeEmpty())
+		})
+	})
+
+	Describe("Spool", func() {
+		It("Should drop the oldest batches over the size limit", func() {
+			dir, err := ioutil.TempDir("", "spool")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			line := func(name string) []string {
+				return []string{name + ",host=localhost value=1.5 1500000000000000000\n"}
+			}
+
+			spool := NewSpool(dir, 120)
+			for _, name := range []string{"first", "second", "third"} {
+				Expect(spool.Store(line(name))).To(Succeed())
+			}
+
+			batches, err := spool.Batches()
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(batches).To(HaveLen(2))
+			Expect(batches[0].Lines).To(Equal(line("second")))
+			Expect(batches[1].Lines).To(Equal(line("third")))
+
+			Expect(spool.Remove(batches[0].Name)).To(Succeed())
+			Expect(spool.Batches()).To(HaveLen(1))
+		})
+	})
 })
@@ -0,0 +1,252 @@
+package models
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/go-errors/errors"
+)
+
+const (
+	aggregateCount       = "count"
+	aggregateMerged      = "merged"
+	aggregateWeightedAvg = "wavg"
+)
+
+// aggregator reduces values of a field gathered from all the instances of a service, weights (one per value)
+// are used only by the weighted functions
+type aggregator func(values []float64, weights []float64) float64
+
+var aggregators = map[string]aggregator{
+	"sum":    unweighted(sumValues),
+	"avg":    unweighted(avgValues),
+	"min":    unweighted(minValues),
+	"max":    unweighted(maxValues),
+	"median": unweighted(medianValues),
+	"stddev": unweighted(stddevValues),
+	"wavg":   weightedAvgValues,
+	aggregateCount: func(values []float64, weights []float64) float64 {
+		return float64(len(values))
+	},
+}
+
+// quantiles of the timer fields used by the merged quantile approximation
+var timerQuantiles = map[string]float64{
+	"p50": 0.5,
+	"p99": 0.99,
+}
+
+func unweighted(fn func(values []float64) float64) aggregator {
+	return func(values []float64, weights []float64) float64 {
+		return fn(values)
+	}
+}
+
+// percentilePattern matches two digits of the percentile and its fraction, with or without the dot (p99.9 or the
+// Dropwizard notation p999)
+var percentilePattern = regexp.MustCompile(`^p([0-9]{2})(?:\.([0-9]+)|([0-9]*[1-9]))?$`)
+
+// getAggregator returns aggregation function by its name: sum, avg, wavg (weighted average), min, max, median,
+// stddev, count or a percentile (p90, p99.9 or p999 etc.)
+func getAggregator(name string) (aggregator, error) {
+	if fn, ok := aggregators[name]; ok {
+		return fn, nil
+	}
+
+	if match := percentilePattern.FindStringSubmatch(name); match != nil {
+		p, _ := strconv.ParseFloat(match[1]+"."+match[2]+match[3], 64)
+
+		return func(values []float64, weights []float64) float64 {
+			return percentile(values, p)
+		}, nil
+	}
+
+	return nil, errors.Errorf("Unknown aggregation function: %s", name)
+}
+
+func sumValues(values []float64) float64 {
+	var sum float64
+	for _, value := range values {
+		sum += value
+	}
+
+	return sum
+}
+
+func avgValues(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	return sumValues(values) / float64(len(values))
+}
+
+// weightedAvgValues returns average of the values weighted by the weights, plain average is returned when
+// all the weights are zero (e.g. the whole fleet is idle)
+func weightedAvgValues(values []float64, weights []float64) float64 {
+	var sum, weightSum float64
+	for i, value := range values {
+		if i < len(weights) {
+			sum += value * weights[i]
+			weightSum += weights[i]
+		}
+	}
+
+	if weightSum == 0 {
+		return avgValues(values)
+	}
+
+	return sum / weightSum
+}
+
+func minValues(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	min := values[0]
+	for _, value := range values[1:] {
+		if value < min {
+			min = value
+		}
+	}
+
+	return min
+}
+
+func maxValues(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	max := values[0]
+	for _, value := range values[1:] {
+		if value > max {
+			max = value
+		}
+	}
+
+	return max
+}
+
+func medianValues(values []float64) float64 {
+	return percentile(values, 50)
+}
+
+// stddevValues returns population standard deviation of the values
+func stddevValues(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	avg := avgValues(values)
+	var sum float64
+	for _, value := range values {
+		sum += (value - avg) * (value - avg)
+	}
+
+	return math.Sqrt(sum / float64(len(values)))
+}
+
+// percentile returns p-th percentile of the values using linear interpolation between closest ranks
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	if lower == upper {
+		return sorted[lower]
+	}
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// mergedQuantile approximates the q-quantile of the merged distribution of all the instances.
+//
+// Distribution of every instance is approximated by a piecewise linear CDF going through (0, 0), (p50, 0.5),
+// (p99, 0.99) and reaching 1 with the slope between p50 and p99. The weighted mixture of these CDFs is then
+// inverted by bisection.
+func mergedQuantile(p50s []float64, p99s []float64, weights []float64, q float64) float64 {
+	if len(p50s) == 0 || len(p50s) != len(p99s) {
+		return 0
+	}
+
+	if len(weights) != len(p50s) {
+		weights = nil
+	}
+	var weightSum float64
+	for _, weight := range weights {
+		weightSum += weight
+	}
+	if weightSum == 0 {
+		weights = make([]float64, len(p50s))
+		for i := range weights {
+			weights[i] = 1
+		}
+		weightSum = float64(len(weights))
+	}
+
+	var high float64
+	for i := range p50s {
+		if end := quantileEnd(p50s[i], p99s[i]); end > high {
+			high = end
+		}
+	}
+
+	low := 0.0
+	for i := 0; i < 100; i++ {
+		mid := (low + high) / 2
+		var cdf float64
+		for j := range p50s {
+			cdf += weights[j] * approximateCDF(p50s[j], p99s[j], mid)
+		}
+
+		if cdf/weightSum < q {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+
+	return (low + high) / 2
+}
+
+// quantileEnd returns the point where the approximated CDF reaches 1
+func quantileEnd(p50 float64, p99 float64) float64 {
+	if p99 <= p50 {
+		return p99
+	}
+
+	return p99 + (p99-p50)*0.01/0.49
+}
+
+// approximateCDF returns value of the approximated CDF at x
+func approximateCDF(p50 float64, p99 float64, x float64) float64 {
+	switch {
+	case x <= 0:
+		return 0
+	case p99 <= p50:
+		// p99 not above p50 - linear up to p99
+		if x < p99 {
+			return 0.99 * x / p99
+		}
+		return 1
+	case x <= p50:
+		return 0.5 * x / p50
+	case x <= p99:
+		return 0.5 + 0.49*(x-p50)/(p99-p50)
+	case x <= quantileEnd(p50, p99):
+		return 0.99 + 0.01*(x-p99)/(quantileEnd(p50, p99)-p99)
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,177 @@
+package models_test
+
+import (
+	"fmt"
+	"math"
+
+	. "github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Aggregations", func() {
+	metrics := []SimpleMetrics{}
+	for i, value := range []string{"4", "1", "3", "2", "10"} {
+		metrics = append(metrics, SimpleMetrics{
+			Service: ServiceInfo{Name: "test-service", ID: fmt.Sprint(i), Host: "localhost"},
+			Metrics: PandoraMetrics{
+				Gauges: map[string]PandoraGauge{"threads": {Value: []byte(value)}},
+				Timers: map[string]PandoraTimer{"requests": {Count: uint64(i * 10), P50: float64(i), P99: float64(i * 2), M1Rate: 1}},
+			},
+		})
+	}
+
+	It("Should compute all the supported functions", func() {
+		filter := Filter{
+			Group: "gauges",
+			Path:  "^threads$",
+			Aggregations: map[string][]string{
+				"value": {"sum", "avg", "min", "max", "median", "stddev", "count", "p90", "p50"},
+			},
+		}
+
+		result := filter.ParseMany("test-service", metrics)
+
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Fields).To(HaveLen(9))
+		Expect(result[0].Fields["value_sum"]).To(Equal(20.0))
+		Expect(result[0].Fields["value_avg"]).To(Equal(4.0))
+		Expect(result[0].Fields["value_min"]).To(Equal(1.0))
+		Expect(result[0].Fields["value_max"]).To(Equal(10.0))
+		Expect(result[0].Fields["value_median"]).To(Equal(3.0))
+		Expect(result[0].Fields["value_p50"]).To(Equal(3.0))
+		Expect(result[0].Fields["value_p90"]).To(BeNumerically("~", 7.6, 1e-9))
+		Expect(result[0].Fields["value_stddev"]).To(BeNumerically("~", math.Sqrt(10), 1e-9))
+		Expect(result[0].Fields["value_count"]).To(Equal(5))
+	})
+
+	It("Should aggregate selected timer fields", func() {
+		filter := Filter{
+			Group: "timers",
+			Path:  "^requests$",
+			Aggregations: map[string][]string{
+				"p99":   {"max", "p999"},
+				"value": {"sum"},
+			},
+		}
+
+		result := filter.ParseMany("test-service", metrics)
+
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Fields).To(HaveLen(3))
+		Expect(result[0].Fields["p99_max"]).To(Equal(8.0))
+		Expect(result[0].Fields["p99_p999"]).To(BeNumerically("~", 7.992, 1e-9))
+		Expect(result[0].Fields["value_sum"]).To(Equal(100.0))
+	})
+
+	It("Should reject unknown functions and fields", func() {
+		_, err := NewFilters([]Filter{{Group: "gauges", Path: "threads", Aggregations: map[string][]string{"value": {"mode"}}}})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewFilters([]Filter{{Group: "gauges", Path: "threads", Aggregations: map[string][]string{"p99": {"max"}}}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Should parse percentiles strictly", func() {
+		filter := Filter{Group: "timers", Path: "^requests$", Aggregations: map[string][]string{"p99": {"p99.9", "p999", "p90"}}}
+		result := filter.ParseMany("test-service", metrics)
+		Expect(result[0].Fields["p99_p99.9"]).To(Equal(result[0].Fields["p99_p999"]))
+
+		for _, name := range []string{"p1000", "p5000", "p100", "p9", "p99.", "p99.9.9", "p99x"} {
+			_, err := NewFilters([]Filter{{Group: "gauges", Path: "threads", Aggregations: map[string][]string{"value": {name}}}})
+			Expect(err).To(HaveOccurred(), name)
+		}
+	})
+
+	Context("With skewed traffic", func() {
+		// one busy instance with low latency and one idle instance with a high p99
+		skewed := []SimpleMetrics{
+			{
+				Service: ServiceInfo{Name: "test-service", ID: "busy", Host: "localhost"},
+				Metrics: PandoraMetrics{Timers: map[string]PandoraTimer{"requests": {Count: 990, P50: 10, P99: 20, M1Rate: 99}}},
+			},
+			{
+				Service: ServiceInfo{Name: "test-service", ID: "idle", Host: "localhost"},
+				Metrics: PandoraMetrics{Timers: map[string]PandoraTimer{"requests": {Count: 10, P50: 100, P99: 1000, M1Rate: 1}}},
+			},
+		}
+
+		It("Should weight default percentile averages", func() {
+			plain := Filter{Group: "timers", Path: "^requests$"}
+			byRate := Filter{Group: "timers", Path: "^requests$", Weight: "m1_rate"}
+			byCount := Filter{Group: "timers", Path: "^requests$", Weight: "count"}
+
+			Expect(plain.ParseMany("test-service", skewed)[0].Fields["p99_avg"]).To(Equal(510.0))
+
+			result := byRate.ParseMany("test-service", skewed)
+			Expect(result).To(HaveLen(1))
+			Expect(result[0].Fields["p50_avg"]).To(BeNumerically("~", 10.9, 1e-9))
+			Expect(result[0].Fields["p99_avg"]).To(BeNumerically("~", 29.8, 1e-9))
+			Expect(result[0].Fields["p99_max"]).To(Equal(1000.0))
+			Expect(result[0].Fields["m1_avg"]).To(Equal(50.0))
+
+			result = byCount.ParseMany("test-service", skewed)
+			Expect(result[0].Fields["p99_avg"]).To(BeNumerically("~", 29.8, 1e-9))
+		})
+
+		It("Should compute weighted average, max and merged quantiles", func() {
+			filter := Filter{
+				Group:  "timers",
+				Path:   "^requests$",
+				Weight: "m1_rate",
+				Aggregations: map[string][]string{
+					"p50": {"merged"},
+					"p99": {"avg", "wavg", "max", "merged"},
+				},
+			}
+
+			result := filter.ParseMany("test-service", skewed)
+
+			Expect(result).To(HaveLen(1))
+			Expect(result[0].Fields["p99_avg"]).To(Equal(510.0))
+			Expect(result[0].Fields["p99_wavg"]).To(BeNumerically("~", 29.8, 1e-9))
+			Expect(result[0].Fields["p99_max"]).To(Equal(1000.0))
+			// 1% of the requests are served by the idle instance, so the fleet p99 lies between the p99 values
+			Expect(result[0].Fields["p99_merged"]).To(BeNumerically(">", 20.0))
+			Expect(result[0].Fields["p99_merged"]).To(BeNumerically("<", 1000.0))
+			Expect(result[0].Fields["p99_merged"]).To(BeNumerically("<", result[0].Fields["p99_avg"].(float64)))
+			Expect(result[0].Fields["p50_merged"]).To(BeNumerically("~", 10.0, 0.5))
+		})
+
+		It("Should fall back to plain average when all the weights are zero", func() {
+			idle := []SimpleMetrics{
+				{Service: ServiceInfo{ID: "1"}, Metrics: PandoraMetrics{Timers: map[string]PandoraTimer{"requests": {P50: 1, P99: 2}}}},
+				{Service: ServiceInfo{ID: "2"}, Metrics: PandoraMetrics{Timers: map[string]PandoraTimer{"requests": {P50: 3, P99: 4}}}},
+			}
+			filter := Filter{Group: "timers", Path: "^requests$", Weight: "m1_rate"}
+
+			result := filter.ParseMany("test-service", idle)
+
+			Expect(result[0].Fields["p50_avg"]).To(Equal(2.0))
+			Expect(result[0].Fields["p99_avg"]).To(Equal(3.0))
+		})
+
+		It("Should reject weighted functions without weight", func() {
+			_, err := NewFilters([]Filter{{Group: "timers", Path: "requests", Aggregations: map[string][]string{"p99": {"wavg"}}}})
+			Expect(err).To(HaveOccurred())
+
+			_, err = NewFilters([]Filter{{Group: "timers", Path: "requests", Aggregations: map[string][]string{"p99": {"merged"}}}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should reject invalid weights and merged outside of timer percentiles", func() {
+			_, err := NewFilters([]Filter{{Group: "timers", Path: "requests", Weight: "p99"}})
+			Expect(err).To(HaveOccurred())
+
+			_, err = NewFilters([]Filter{{Group: "gauges", Path: "threads", Weight: "count"}})
+			Expect(err).To(HaveOccurred())
+
+			_, err = NewFilters([]Filter{{Group: "timers", Path: "requests", Weight: "count", Aggregations: map[string][]string{"m1_rate": {"merged"}}}})
+			Expect(err).To(HaveOccurred())
+
+			_, err = NewFilters([]Filter{{Group: "timers", Path: "requests", Weight: "count", Aggregations: map[string][]string{"p99": {"merged", "wavg"}}}})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// SeriesID returns identifier of the series a metric belongs to: measurement and sorted tags
+func SeriesID(metric FilteredMetrics) string {
+	keys := make([]string, 0, len(metric.Tags))
+	for k := range metric.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys)+1)
+	parts = append(parts, metric.Measurement)
+	for _, k := range keys {
+		parts = append(parts, k+"="+metric.Tags[k])
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// LimitSeries keeps metrics of at most max series and returns number of dropped series. Series are dropped
+// deterministically - the ones with the greatest identifiers are dropped first, max <= 0 means no limit.
+func LimitSeries(metrics []FilteredMetrics, max int) ([]FilteredMetrics, int) {
+	if max <= 0 {
+		return metrics, 0
+	}
+
+	series := map[string]bool{}
+	for _, metric := range metrics {
+		series[SeriesID(metric)] = true
+	}
+	if len(series) <= max {
+		return metrics, 0
+	}
+
+	ids := make([]string, 0, len(series))
+	for id := range series {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids[max:] {
+		series[id] = false
+	}
+
+	result := []FilteredMetrics{}
+	for _, metric := range metrics {
+		if series[SeriesID(metric)] {
+			result = append(result, metric)
+		}
+	}
+
+	return result, len(ids) - max
+}
@@ -0,0 +1,64 @@
+package models_test
+
+import (
+	"fmt"
+
+	. "github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cardinality", func() {
+	series := func(name string) FilteredMetrics {
+		return FilteredMetrics{
+			Measurement: "http_resources",
+			Tags:        map[string]string{"metric_name": name, "host": "localhost"},
+			Fields:      map[string]interface{}{"value": 1},
+		}
+	}
+
+	It("Should identify series by measurement and sorted tags", func() {
+		Expect(SeriesID(series("a"))).To(Equal("http_resources,host=localhost,metric_name=a"))
+	})
+
+	It("Should drop series deterministically", func() {
+		metrics := []FilteredMetrics{series("d"), series("a"), series("c"), series("a"), series("b")}
+
+		kept, dropped := LimitSeries(metrics, 2)
+
+		Expect(dropped).To(Equal(2))
+		Expect(kept).To(Equal([]FilteredMetrics{series("a"), series("a"), series("b")}))
+
+		kept, dropped = LimitSeries(metrics, 0)
+		Expect(dropped).To(Equal(0))
+		Expect(kept).To(HaveLen(5))
+	})
+
+	It("Should limit series of a filter", func() {
+		timers := map[string]PandoraTimer{}
+		for i := 0; i < 10; i++ {
+			timers[fmt.Sprintf("com.wikia.Resource.endpoint%d", i)] = PandoraTimer{Count: 1}
+		}
+		grouped := GroupedMetrics{
+			"test-service": {{Service: ServiceInfo{Name: "test-service", ID: "1", Host: "localhost"}, Metrics: PandoraMetrics{Timers: timers}}},
+		}
+		filters, err := NewFilters([]Filter{
+			{Group: "timers", Path: ".*", Measurement: "http_resources", MaxSeries: 5},
+			{Group: "timers", Path: "endpoint1$", Measurement: "endpoint1"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result, dropped := filters.CombineLimited(grouped)
+
+		// 10 instance and 10 aggregate series of the first filter, 2 series of the second one
+		Expect(result).To(HaveLen(7))
+		Expect(dropped).To(Equal(map[string]int{".*": 15}))
+		for _, metric := range result[:5] {
+			Expect(metric.Measurement).To(Equal("http_resources"))
+		}
+
+		_, err = NewFilters([]Filter{{Group: "timers", Path: ".*", MaxSeries: -1}})
+		Expect(err).To(HaveOccurred())
+	})
+})
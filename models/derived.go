@@ -0,0 +1,223 @@
+package models
+
+import (
+	"math"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+)
+
+const defaultDerivedField = "value"
+
+// MetricSelector selects a field of filtered metrics, empty Measurement or MetricName match any metric
+type MetricSelector struct {
+	Measurement string
+	MetricName  string `mapstructure:"metric_name"`
+	Field       string
+}
+
+func (s MetricSelector) matches(metric FilteredMetrics) bool {
+	if len(s.Measurement) != 0 && s.Measurement != metric.Measurement {
+		return false
+	}
+	if len(s.MetricName) != 0 && s.MetricName != metric.Tags["metric_name"] {
+		return false
+	}
+	_, ok := metric.Fields[s.Field]
+
+	return ok
+}
+
+// Derived defines a metric computed from already filtered metrics, e.g. "active / max".
+//
+// Expression is evaluated for every set of metrics sharing all the tags but metric_name (the same instance or
+// the same aggregate group). Variables maps names used in the expression to fields of filtered metrics, names
+// not listed there are fields of the metric selected by Source. No metric is produced when any of the variables
+// is missing or the expression divides by zero.
+type Derived struct {
+	// Measurement of the resulting metrics
+	Measurement string
+	// MetricName is the metric_name tag of the resulting metrics
+	MetricName string `mapstructure:"metric_name"`
+	// Field is the name of the resulting field (value by default)
+	Field string
+	// Expr is an arithmetic expression with + - * / operators, parentheses and abs/min/max functions
+	Expr string
+	// Variables maps names used in Expr to fields of filtered metrics
+	Variables map[string]MetricSelector
+	// Source selects metrics providing fields used in Expr and not listed in Variables
+	Source MetricSelector
+
+	expression expression
+}
+
+// DerivedMetrics is a list of compiled derived metrics definitions
+type DerivedMetrics []Derived
+
+// NewDerivedMetrics compiles expressions of all the definitions, invalid ones are rejected
+func NewDerivedMetrics(derived []Derived) (DerivedMetrics, error) {
+	result := make(DerivedMetrics, len(derived))
+	for i, d := range derived {
+		if d.expression == nil {
+			if err := d.Compile(); err != nil {
+				return nil, err
+			}
+		}
+		result[i] = d
+	}
+
+	return result, nil
+}
+
+// Compile validates the definition and parses its expression
+func (d *Derived) Compile() error {
+	if len(d.Measurement) == 0 {
+		return errors.Errorf("Missing measurement of derived metric: %s", d.Expr)
+	}
+
+	e, err := parseExpression(d.Expr)
+	if err != nil {
+		return errors.WrapPrefix(err, "Invalid derived metric "+d.Measurement, 0)
+	}
+
+	for name, selector := range d.Variables {
+		if len(selector.Field) == 0 {
+			return errors.Errorf("Missing field of variable '%s' in derived metric %s", name, d.Measurement)
+		}
+	}
+
+	d.expression = e
+
+	return nil
+}
+
+// selector returns selector of a variable used in the expression
+func (d Derived) selector(name string) MetricSelector {
+	if selector, ok := d.Variables[name]; ok {
+		return selector
+	}
+
+	selector := d.Source
+	selector.Field = name
+
+	return selector
+}
+
+// derive evaluates the expression over metrics of a single scope, false is returned when it cannot be evaluated
+func (d Derived) derive(tags map[string]string, metrics []FilteredMetrics) (FilteredMetrics, bool) {
+	values := map[string]float64{}
+	for _, name := range variables(d.expression) {
+		if _, ok := values[name]; ok {
+			continue
+		}
+
+		selector := d.selector(name)
+		found := false
+		for _, metric := range metrics {
+			if !selector.matches(metric) {
+				continue
+			}
+			if value, ok := toFloat(metric.Fields[selector.Field]); ok {
+				values[name] = value
+				found = true
+				break
+			}
+		}
+		if !found {
+			return FilteredMetrics{}, false
+		}
+	}
+
+	value, err := d.expression.eval(values)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{"measurement": d.Measurement, "expr": d.Expr}).Debug("Cannot evaluate derived metric")
+		return FilteredMetrics{}, false
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return FilteredMetrics{}, false
+	}
+
+	result := NewFilteredMetric()
+	result.Measurement = d.Measurement
+	for k, v := range tags {
+		result.Tags[k] = v
+	}
+	if len(d.MetricName) != 0 {
+		result.Tags["metric_name"] = d.MetricName
+	}
+	field := d.Field
+	if len(field) == 0 {
+		field = defaultDerivedField
+	}
+	result.Fields[field] = value
+
+	return result, true
+}
+
+// Apply evaluates all the definitions and returns the derived metrics, the given metrics are not modified
+func (ds DerivedMetrics) Apply(metrics []FilteredMetrics) []FilteredMetrics {
+	results := []FilteredMetrics{}
+	if len(ds) == 0 {
+		return results
+	}
+
+	scopes := []string{}
+	scopeTags := map[string]map[string]string{}
+	scopeInstances := map[string]string{}
+	scopeMetrics := map[string][]FilteredMetrics{}
+	for _, metric := range metrics {
+		tags := map[string]string{}
+		for k, v := range metric.Tags {
+			if k != "metric_name" {
+				tags[k] = v
+			}
+		}
+
+		// instances of a service can share a host, the instance (service_id field) is a part of the scope
+		instance, _ := metric.Fields["service_id"].(string)
+		id := metricKey{name: instance, tags: tags}.id()
+		if _, ok := scopeTags[id]; !ok {
+			scopes = append(scopes, id)
+			scopeTags[id] = tags
+			scopeInstances[id] = instance
+		}
+		scopeMetrics[id] = append(scopeMetrics[id], metric)
+	}
+
+	for _, d := range ds {
+		for _, id := range scopes {
+			if metric, ok := d.derive(scopeTags[id], scopeMetrics[id]); ok {
+				if instance := scopeInstances[id]; len(instance) != 0 {
+					metric.Fields["service_id"] = instance
+				}
+				results = append(results, metric)
+			}
+		}
+	}
+
+	return results
+}
+
+// toFloat converts numeric field value to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,130 @@
+package models_test
+
+import (
+	. "github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DerivedMetrics", func() {
+	pool := func(host string, metricName string, value interface{}) FilteredMetrics {
+		return FilteredMetrics{
+			Measurement: "db_pool",
+			Tags:        map[string]string{"service_name": "test-service", "host": host, "metric_name": metricName},
+			Fields:      map[string]interface{}{"value": value, "service_id": "1"},
+		}
+	}
+	metrics := []FilteredMetrics{
+		pool("host-1", "pool.active", 5.0),
+		pool("host-1", "pool.max", 20),
+		pool("host-2", "pool.active", 3.0),
+		pool("host-2", "pool.max", 0),
+		pool("host-3", "pool.active", 1.0),
+	}
+
+	It("Should evaluate expressions for every instance", func() {
+		derived, err := NewDerivedMetrics([]Derived{
+			{
+				Measurement: "db_pool_usage",
+				MetricName:  "pool.usage",
+				Field:       "usage",
+				Expr:        "active / max",
+				Variables: map[string]MetricSelector{
+					"active": {MetricName: "pool.active", Field: "value"},
+					"max":    {MetricName: "pool.max", Field: "value"},
+				},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result := derived.Apply(metrics)
+
+		// division by zero on host-2 and missing max on host-3 produce no metrics
+		Expect(result).To(Equal([]FilteredMetrics{
+			{
+				Measurement: "db_pool_usage",
+				Tags:        map[string]string{"service_name": "test-service", "host": "host-1", "metric_name": "pool.usage"},
+				Fields:      map[string]interface{}{"usage": 0.25, "service_id": "1"},
+			},
+		}))
+	})
+
+	It("Should keep instances sharing a host apart", func() {
+		instance := func(id string, metricName string, value float64) FilteredMetrics {
+			metric := pool("host-1", metricName, value)
+			metric.Fields["service_id"] = id
+			return metric
+		}
+		derived, err := NewDerivedMetrics([]Derived{
+			{
+				Measurement: "db_pool_usage",
+				Expr:        "active / max",
+				Variables: map[string]MetricSelector{
+					"active": {MetricName: "pool.active", Field: "value"},
+					"max":    {MetricName: "pool.max", Field: "value"},
+				},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result := derived.Apply([]FilteredMetrics{
+			instance("1", "pool.active", 5),
+			instance("2", "pool.active", 1),
+			instance("2", "pool.max", 10),
+			instance("1", "pool.max", 20),
+		})
+
+		Expect(result).To(HaveLen(2))
+		Expect(result[0].Fields).To(Equal(map[string]interface{}{"value": 0.25, "service_id": "1"}))
+		Expect(result[1].Fields).To(Equal(map[string]interface{}{"value": 0.1, "service_id": "2"}))
+	})
+
+	It("Should parse numbers with signed exponents", func() {
+		derived, err := NewDerivedMetrics([]Derived{{Measurement: "test", Expr: "value * 1e-3 + 2.5E+2 - 1e2", Source: MetricSelector{MetricName: "pool.active"}}})
+		Expect(err).NotTo(HaveOccurred())
+
+		result := derived.Apply(metrics[:1])
+
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Fields["value"]).To(BeNumerically("~", 150.005, 1e-9))
+	})
+
+	It("Should use fields of the source metric", func() {
+		timers := []FilteredMetrics{
+			{
+				Measurement: "metric_graphs",
+				Tags:        map[string]string{"service_name": "test-service", "metric_name": "requests"},
+				Fields:      map[string]interface{}{"p99_max": 30.0, "p99_avg": 10.0, "count": 3},
+			},
+		}
+		derived, err := NewDerivedMetrics([]Derived{
+			{
+				Measurement: "latency_skew",
+				Expr:        "(p99_max - p99_avg) / max(p99_avg, 1) * -count",
+				Source:      MetricSelector{Measurement: "metric_graphs", MetricName: "requests"},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result := derived.Apply(timers)
+
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Tags).To(Equal(map[string]string{"service_name": "test-service"}))
+		Expect(result[0].Fields).To(Equal(map[string]interface{}{"value": -6.0}))
+	})
+
+	It("Should reject invalid definitions", func() {
+		for _, d := range []Derived{
+			{Measurement: "test", Expr: "a /"},
+			{Measurement: "test", Expr: "(a + b"},
+			{Measurement: "test", Expr: "a b"},
+			{Measurement: "test", Expr: "median(a)"},
+			{Measurement: "test", Expr: "a", Variables: map[string]MetricSelector{"a": {MetricName: "a"}}},
+			{Expr: "a"},
+		} {
+			_, err := NewDerivedMetrics([]Derived{d})
+			Expect(err).To(HaveOccurred(), d.Expr)
+		}
+	})
+})
@@ -0,0 +1,321 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+
+	"github.com/go-errors/errors"
+)
+
+// ErrDivisionByZero is returned when an expression divides by zero
+var ErrDivisionByZero = errors.New("division by zero")
+
+// expression is an arithmetic expression over named variables
+type expression interface {
+	eval(variables map[string]float64) (float64, error)
+}
+
+type numberExpression float64
+
+func (e numberExpression) eval(variables map[string]float64) (float64, error) {
+	return float64(e), nil
+}
+
+type variableExpression string
+
+func (e variableExpression) eval(variables map[string]float64) (float64, error) {
+	value, ok := variables[string(e)]
+	if !ok {
+		return 0, errors.Errorf("Unknown variable: %s", string(e))
+	}
+
+	return value, nil
+}
+
+type negateExpression struct {
+	operand expression
+}
+
+func (e negateExpression) eval(variables map[string]float64) (float64, error) {
+	value, err := e.operand.eval(variables)
+	return -value, err
+}
+
+type binaryExpression struct {
+	operator    byte
+	left, right expression
+}
+
+func (e binaryExpression) eval(variables map[string]float64) (float64, error) {
+	left, err := e.left.eval(variables)
+	if err != nil {
+		return 0, err
+	}
+	right, err := e.right.eval(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	switch e.operator {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	case '/':
+		if right == 0 {
+			return 0, ErrDivisionByZero
+		}
+		return left / right, nil
+	}
+
+	return 0, errors.Errorf("Unknown operator: %c", e.operator)
+}
+
+// functions available in expressions
+var expressionFunctions = map[string]func(args []float64) (float64, error){
+	"abs": func(args []float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, errors.Errorf("abs() takes exactly one argument")
+		}
+		return math.Abs(args[0]), nil
+	},
+	"min": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.Errorf("min() takes at least one argument")
+		}
+		return minValues(args), nil
+	},
+	"max": func(args []float64) (float64, error) {
+		if len(args) == 0 {
+			return 0, errors.Errorf("max() takes at least one argument")
+		}
+		return maxValues(args), nil
+	},
+}
+
+type callExpression struct {
+	name string
+	args []expression
+}
+
+func (e callExpression) eval(variables map[string]float64) (float64, error) {
+	args := make([]float64, len(e.args))
+	for i, arg := range e.args {
+		value, err := arg.eval(variables)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+
+	return expressionFunctions[e.name](args)
+}
+
+// expressionParser is a recursive descent parser of arithmetic expressions:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/") unary }
+//	unary      = "-" unary | primary
+//	primary    = number | identifier | identifier "(" [ expression { "," expression } ] ")" | "(" expression ")"
+type expressionParser struct {
+	source   string
+	position int
+}
+
+// parseExpression parses an arithmetic expression with + - * / operators, parentheses, numbers, variables
+// (letters, digits, "_" and ".") and abs/min/max functions
+func parseExpression(source string) (expression, error) {
+	p := &expressionParser{source: source}
+
+	result, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.position != len(p.source) {
+		return nil, p.errorf("Unexpected '%c'", p.source[p.position])
+	}
+
+	return result, nil
+}
+
+func (p *expressionParser) errorf(format string, args ...interface{}) error {
+	return errors.Errorf("Invalid expression '%s' at %d: %s", p.source, p.position, fmt.Sprintf(format, args...))
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.position < len(p.source) && unicode.IsSpace(rune(p.source[p.position])) {
+		p.position++
+	}
+}
+
+// peek returns next non-space character, 0 at the end of the source
+func (p *expressionParser) peek() byte {
+	p.skipSpaces()
+	if p.position == len(p.source) {
+		return 0
+	}
+
+	return p.source[p.position]
+}
+
+func (p *expressionParser) expression() (expression, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for operator := p.peek(); operator == '+' || operator == '-'; operator = p.peek() {
+		p.position++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression{operator: operator, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *expressionParser) term() (expression, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for operator := p.peek(); operator == '*' || operator == '/'; operator = p.peek() {
+		p.position++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression{operator: operator, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *expressionParser) unary() (expression, error) {
+	if p.peek() == '-' {
+		p.position++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negateExpression{operand: operand}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *expressionParser) primary() (expression, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, p.errorf("Unexpected end of expression")
+	case c == '(':
+		p.position++
+		inner, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("Expected ')'")
+		}
+		p.position++
+		return inner, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.position
+		for p.position < len(p.source) && isNumberChar(p.source[p.position], p.source[p.position-1]) {
+			p.position++
+		}
+		value, err := strconv.ParseFloat(p.source[start:p.position], 64)
+		if err != nil {
+			p.position = start
+			return nil, p.errorf("Invalid number")
+		}
+		return numberExpression(value), nil
+	case isIdentifierChar(c):
+		start := p.position
+		for p.position < len(p.source) && isIdentifierChar(p.source[p.position]) {
+			p.position++
+		}
+		name := p.source[start:p.position]
+		if p.peek() != '(' {
+			return variableExpression(name), nil
+		}
+		return p.call(name)
+	}
+
+	return nil, p.errorf("Unexpected '%c'", c)
+}
+
+func (p *expressionParser) call(name string) (expression, error) {
+	if _, ok := expressionFunctions[name]; !ok {
+		return nil, p.errorf("Unknown function %s", name)
+	}
+	p.position++
+
+	result := callExpression{name: name}
+	if p.peek() == ')' {
+		p.position++
+		return result, nil
+	}
+
+	for {
+		arg, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		result.args = append(result.args, arg)
+
+		switch p.peek() {
+		case ',':
+			p.position++
+		case ')':
+			p.position++
+			return result, nil
+		default:
+			return nil, p.errorf("Expected ',' or ')'")
+		}
+	}
+}
+
+// isNumberChar checks if c continues a number after the previous character, a sign is accepted only right after
+// the exponent marker (e.g. 1e-3)
+func isNumberChar(c byte, previous byte) bool {
+	if c == '+' || c == '-' {
+		return previous == 'e' || previous == 'E'
+	}
+
+	return c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E'
+}
+
+func isIdentifierChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.'
+}
+
+// variables returns names of all the variables used in the expression
+func variables(e expression) []string {
+	switch e := e.(type) {
+	case variableExpression:
+		return []string{string(e)}
+	case negateExpression:
+		return variables(e.operand)
+	case binaryExpression:
+		return append(variables(e.left), variables(e.right)...)
+	case callExpression:
+		result := []string{}
+		for _, arg := range e.args {
+			result = append(result, variables(arg)...)
+		}
+		return result
+	}
+
+	return nil
+}
@@ -1,7 +1,11 @@
 package models
 
 import (
+	"bytes"
 	"regexp"
+	"sort"
+	"strings"
+	"text/template"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/go-errors/errors"
@@ -12,86 +16,682 @@ const (
 	filterGauge     = "gauges"
 	filterHistogram = "histograms"
 	filterTimer     = "timers"
+
+	defaultAggregateMeasurement = "metric_graphs"
+
+	templateMeasurement          = "measurement"
+	templateAggregateMeasurement = "aggregate_measurement"
+	templateMetricName           = "metric_name"
+	templateFieldPrefix          = "field."
+
+	emitInstance  = "instance"
+	emitAggregate = "aggregate"
+
+	dimensionServiceName = "service_name"
+	dimensionHost        = "host"
+	dimensionMetricName  = "metric_name"
 )
 
-// Filter defines metric filters to be applied
+// groupFields lists per instance fields of every group which can be aggregated
+var groupFields = map[string][]string{
+	filterGauge: {"value"},
+	filterMeter: {"value", "m1_rate"},
+	filterTimer: {"value", "m1_rate", "p50", "p99"},
+}
+
+// Filter defines metric filters to be applied.
+//
+// Named capture groups in Path (e.g. "jvm.memory.pools.(?P<pool>.*).usage") are added as tags to the
+// resulting metrics, the captured part of metric_name is replaced by a placeholder ("jvm.memory.pools.{pool}.usage")
+// so the aggregates are grouped by the captured values.
+//
+// Measurement, AggregateMeasurement, MetricName and Fields are text/template templates executed with the named
+// captures, service_name, group (filter group) and metric_name (key with placeholders), e.g. "jvm_{{.pool}}".
+//
+// Emit selects which metrics are produced by Combine: "instance" (ParseSingle), "aggregate" (ParseMany) or both
+// (default). Aggregations replaces the default set of aggregated fields with given functions per instance field,
+// resulting fields are named "<field>_<function>". Weight selects instance field (m1_rate or count) weighting
+// the instances in the "wavg" and "merged" functions and in p50_avg/p99_avg of the default timer aggregates.
+//
+// GroupBy replaces the default grouping of the aggregates (service name, service tags and named captures) with
+// a list of dimensions: service_name, host, a named capture, a service tag or a Marathon label. Aggregates are always grouped by
+// the metric name, so GroupBy without service_name aggregates across all the services.
 type Filter struct {
 	Group       string
 	Path        string
 	Measurement string
+	// AggregateMeasurement is the measurement of the aggregated metrics (metric_graphs by default)
+	AggregateMeasurement string `mapstructure:"aggregate_measurement"`
+	// MetricName overrides value of the metric_name tag
+	MetricName string `mapstructure:"metric_name"`
+	// Fields renames fields of the resulting metrics (field name -> new name)
+	Fields map[string]string
+	// Emit lists kinds of metrics produced by the filter: instance, aggregate
+	Emit []string
+	// Aggregations maps instance field to aggregation functions (sum, avg, min, max, median, stddev, count, pNN)
+	Aggregations map[string][]string
+	// Weight is the instance field used as weight by the weighted aggregations: m1_rate or count
+	Weight string
+	// GroupBy lists dimensions the aggregates are grouped by: service_name, host, named captures, tags or labels
+	GroupBy []string `mapstructure:"group_by"`
+	// MaxSeries limits number of series produced by the filter in a single run (0 means no limit)
+	MaxSeries int `mapstructure:"max_series"`
+
+	re        *regexp.Regexp
+	templates map[string]*template.Template
+}
+
+// Filters is a list of compiled filters, metrics are matched against all of them in a single pass
+type Filters []Filter
+
+// metricKey identifies a metric matched by a filter
+type metricKey struct {
+	// name is the metric key with named captures replaced by placeholders
+	name string
+	// tags holds values of the named captures
+	tags map[string]string
+}
+
+// id returns a string uniquely identifying the key (used for grouping)
+func (k metricKey) id() string {
+	names := make([]string, 0, len(k.tags))
+	for name := range k.tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := []string{k.name}
+	for _, name := range names {
+		parts = append(parts, name+"="+k.tags[name])
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+// matchedMetrics holds metrics of a single instance matched by a filter
+type matchedMetrics struct {
+	SimpleMetrics
+	keys map[string]metricKey
+	// serviceName is the name the instance is grouped under
+	serviceName string
+}
+
+// NewFilters compiles paths of all the filters, invalid filters are rejected. Filters of unsupported groups (e.g.
+// histograms) never match any metric, they are logged and skipped.
+func NewFilters(filters []Filter) (Filters, error) {
+	result := make(Filters, 0, len(filters))
+	for _, filter := range filters {
+		if !supportedGroup(filter.Group) {
+			log.WithField("path", filter.Path).Errorf("Unknown filter group: %s - skipping", filter.Group)
+			continue
+		}
+		if filter.re == nil {
+			if err := filter.Compile(); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, filter)
+	}
+
+	return result, nil
 }
 
-func (f Filter) match(key string) (bool, error) {
-	match, err := regexp.MatchString(f.Path, key)
+// Compile validates the filter and compiles its path
+func (f *Filter) Compile() error {
+	if !supportedGroup(f.Group) {
+		return errors.Errorf("Unknown filter group '%s' for path: %s", f.Group, f.Path)
+	}
+
+	re, err := regexp.Compile(f.Path)
 	if err != nil {
-		err = errors.Wrap(err, 0)
-		log.WithError(err).WithFields(log.Fields{"path": f.Path, "metric": key}).Error("Error matching filter to a metric")
-		return false, err
+		return errors.WrapPrefix(err, "Invalid filter path: "+f.Path, 0)
+	}
+
+	for _, kind := range f.Emit {
+		if kind != emitInstance && kind != emitAggregate {
+			return errors.Errorf("Unknown emit option '%s' for path: %s", kind, f.Path)
+		}
+	}
+
+	if len(f.Weight) != 0 && (f.Group == filterGauge || (f.Weight != aggregateCount && f.Weight != "m1_rate")) {
+		return errors.Errorf("Invalid weight '%s' in %s for path: %s", f.Weight, f.Group, f.Path)
 	}
 
-	return match, nil
+	if f.MaxSeries < 0 {
+		return errors.Errorf("Invalid max_series %d for path: %s", f.MaxSeries, f.Path)
+	}
+
+	for _, dimension := range f.GroupBy {
+		if len(dimension) == 0 {
+			return errors.Errorf("Empty group_by dimension for path: %s", f.Path)
+		}
+	}
+
+	for field, functions := range f.Aggregations {
+		if !hasField(groupFields[f.Group], field) {
+			return errors.Errorf("Field '%s' cannot be aggregated in %s for path: %s", field, f.Group, f.Path)
+		}
+		for _, name := range functions {
+			if (name == aggregateMerged || name == aggregateWeightedAvg) && len(f.Weight) == 0 {
+				return errors.Errorf("Aggregation '%s' of '%s' requires weight for path: %s", name, field, f.Path)
+			}
+			if name == aggregateMerged {
+				if _, ok := timerQuantiles[field]; !ok || f.Group != filterTimer {
+					return errors.Errorf("Merged quantile is supported only for timer p50 and p99, path: %s", f.Path)
+				}
+				continue
+			}
+			if _, err := getAggregator(name); err != nil {
+				return errors.WrapPrefix(err, "Invalid aggregation for path: "+f.Path, 0)
+			}
+		}
+	}
+
+	targets := map[string]string{}
+	for _, field := range f.renamedFields() {
+		name := f.Fields[field]
+		if other, ok := targets[name]; ok {
+			return errors.Errorf("Fields '%s' and '%s' are both renamed to '%s' for path: %s", other, field, name, f.Path)
+		}
+		if _, renamed := f.Fields[name]; !renamed && hasField(groupFields[f.Group], name) {
+			return errors.Errorf("Field '%s' is renamed to existing field '%s' for path: %s", field, name, f.Path)
+		}
+		targets[name] = field
+	}
+
+	templates := map[string]*template.Template{}
+	sources := map[string]string{
+		templateMeasurement:          f.Measurement,
+		templateAggregateMeasurement: f.AggregateMeasurement,
+		templateMetricName:           f.MetricName,
+	}
+	for field, name := range f.Fields {
+		sources[templateFieldPrefix+field] = name
+	}
+	for name, source := range sources {
+		t, err := parseTemplate(name, source)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid filter template for path: "+f.Path, 0)
+		}
+		templates[name] = t
+	}
+
+	f.re = re
+	f.templates = templates
+
+	return nil
 }
 
-func (f Filter) parseGauge(key string, serviceInfo ServiceInfo, metric PandoraGauge) FilteredMetrics {
-	log.Debugf("Found gauge metric %s : %s", key, metric)
-	finalMetric := NewFilteredMetric()
-	finalMetric.Tags = map[string]string{
-		"service_name": serviceInfo.Name,
-		"host":         serviceInfo.Host,
-		"metric_name":  key,
+// renamedFields returns sorted names of the fields renamed by the filter
+func (f Filter) renamedFields() []string {
+	fields := make([]string, 0, len(f.Fields))
+	for field := range f.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+// supportedGroup checks if metrics of the group can be filtered
+func supportedGroup(group string) bool {
+	return group == filterGauge || group == filterMeter || group == filterTimer
+}
+
+func hasField(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emits checks if the filter produces given kind of metrics
+func (f Filter) emits(kind string) bool {
+	return len(f.Emit) == 0 || hasField(f.Emit, kind)
+}
+
+// groupKey returns key the aggregates of a metric are grouped by, tags of the key are the grouping dimensions
+func (f Filter) groupKey(key metricKey, metrics matchedMetrics) metricKey {
+	result := metricKey{name: key.name, tags: map[string]string{}}
+	if len(f.GroupBy) == 0 {
+		for k, v := range metrics.Service.Tags {
+			result.tags[k] = v
+		}
+		for k, v := range key.tags {
+			result.tags[k] = v
+		}
+		result.tags[dimensionServiceName] = metrics.serviceName
+
+		return result
+	}
+
+	for _, dimension := range f.GroupBy {
+		var value string
+		switch dimension {
+		case dimensionMetricName:
+			continue
+		case dimensionServiceName:
+			value = metrics.serviceName
+		case dimensionHost:
+			value = metrics.Service.Host
+		default:
+			var ok bool
+			if value, ok = key.tags[dimension]; !ok {
+				if value, ok = metrics.Service.Tags[dimension]; !ok {
+					value = metrics.Service.Labels[dimension]
+				}
+			}
+		}
+
+		if len(value) != 0 {
+			result.tags[dimension] = value
+		}
+	}
+
+	return result
+}
+
+// weightField returns name of the instance field used as weight
+func (f Filter) weightField() string {
+	// count of meters and timers is reported in the value field
+	if f.Weight == aggregateCount {
+		return "value"
+	}
+
+	return f.Weight
+}
+
+// weights returns weights of the instances, nil when the filter is not weighted
+func (f Filter) weights(instances []map[string]float64) []float64 {
+	if len(f.Weight) == 0 {
+		return nil
+	}
+
+	field := f.weightField()
+	weights := make([]float64, len(instances))
+	for i, instance := range instances {
+		weight, ok := instance[field]
+		if !ok {
+			log.WithFields(log.Fields{"path": f.Path, "weight": f.Weight}).Debug("Weight missing in some of the instances - not weighting")
+			return nil
+		}
+		weights[i] = weight
+	}
+
+	return weights
+}
+
+// aggregate computes configured aggregations of the instance field values
+func (f Filter) aggregate(metric FilteredMetrics, instances []map[string]float64) FilteredMetrics {
+	weights := f.weights(instances)
+
+	for field, functions := range f.Aggregations {
+		values := make([]float64, 0, len(instances))
+		for _, instance := range instances {
+			if value, ok := instance[field]; ok {
+				values = append(values, value)
+			}
+		}
+		// fields missing in some of the instances (see CountOnly) aren't aggregated
+		if len(values) != len(instances) {
+			continue
+		}
+
+		for _, name := range functions {
+			if name == aggregateMerged {
+				p50s := make([]float64, len(instances))
+				p99s := make([]float64, len(instances))
+				for i, instance := range instances {
+					p50s[i] = instance["p50"]
+					p99s[i] = instance["p99"]
+				}
+				metric.Fields[field+"_"+name] = mergedQuantile(p50s, p99s, weights, timerQuantiles[field])
+				continue
+			}
+
+			fn, err := getAggregator(name)
+			if err != nil {
+				log.WithError(err).WithField("path", f.Path).Error("Error aggregating metrics")
+				continue
+			}
+
+			if name == aggregateCount {
+				metric.Fields[field+"_"+name] = len(values)
+			} else {
+				metric.Fields[field+"_"+name] = fn(values, weights)
+			}
+		}
+	}
+
+	return metric
+}
+
+func parseTemplate(name string, source string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Parse(source)
+}
+
+// render executes one of the filter templates, plain strings are returned as they are
+func (f Filter) render(name string, source string, data map[string]string) string {
+	if !strings.Contains(source, "{{") {
+		return source
+	}
+
+	t := f.templates[name]
+	if t == nil {
+		var err error
+		t, err = parseTemplate(name, source)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{"path": f.Path, "template": source}).Error("Error parsing filter template")
+			return source
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.WithError(err).WithFields(log.Fields{"path": f.Path, "template": source}).Error("Error executing filter template")
+		return source
+	}
+
+	return buf.String()
+}
+
+// finalize sets measurement name and applies metric_name and field templates to the resulting metric
+func (f Filter) finalize(metric FilteredMetrics, key metricKey, serviceName string, aggregate bool) FilteredMetrics {
+	data := map[string]string{}
+	for k, v := range key.tags {
+		data[k] = v
 	}
-	finalMetric.Measurement = f.Measurement
+	data["service_name"] = serviceName
+	data["group"] = f.Group
+	data["metric_name"] = key.name
+	metric.Group = f.Group
+
+	if aggregate {
+		measurement := f.AggregateMeasurement
+		if len(measurement) == 0 {
+			measurement = defaultAggregateMeasurement
+		}
+		metric.Measurement = f.render(templateAggregateMeasurement, measurement, data)
+	} else {
+		metric.Measurement = f.render(templateMeasurement, f.Measurement, data)
+	}
+
+	if len(f.MetricName) != 0 {
+		metric.Tags["metric_name"] = f.render(templateMetricName, f.MetricName, data)
+	}
+
+	if len(f.Fields) != 0 {
+		// renamed fields are built from the original ones in a single pass, so swapped and chained renames don't
+		// depend on the map order; renamed fields take precedence over the kept ones
+		fields := make(map[string]interface{}, len(metric.Fields))
+		for field, value := range metric.Fields {
+			if _, ok := f.Fields[field]; !ok {
+				fields[field] = value
+			}
+		}
+		for _, field := range f.renamedFields() {
+			value, ok := metric.Fields[field]
+			if !ok {
+				continue
+			}
+			name := f.render(templateFieldPrefix+field, f.Fields[field], data)
+			fields[name] = value
+			if name != field {
+				if metric.Renamed == nil {
+					metric.Renamed = map[string]string{}
+				}
+				metric.Renamed[name] = field
+			}
+		}
+		metric.Fields = fields
+	}
+
+	return metric
+}
+
+// Matches checks if the path of the filter matches given metric key
+func (f Filter) Matches(key string) bool {
+	matched, _ := f.match(key)
+	return matched
+}
+
+func (f Filter) match(key string) (bool, metricKey) {
+	re := f.re
+	if re == nil {
+		var err error
+		re, err = regexp.Compile(f.Path)
+		if err != nil {
+			err = errors.Wrap(err, 0)
+			log.WithError(err).WithFields(log.Fields{"path": f.Path, "metric": key}).Error("Error matching filter to a metric")
+			return false, metricKey{}
+		}
+	}
+
+	indexes := re.FindStringSubmatchIndex(key)
+	if indexes == nil {
+		return false, metricKey{}
+	}
+
+	result := metricKey{name: key}
+	var name []string
+	last := 0
+	for i, group := range re.SubexpNames() {
+		start, end := indexes[2*i], indexes[2*i+1]
+		// skipping unnamed, not participating and nested groups
+		if len(group) == 0 || start < last {
+			continue
+		}
+
+		if result.tags == nil {
+			result.tags = map[string]string{}
+		}
+		if end > start {
+			result.tags[group] = key[start:end]
+		}
+		name = append(name, key[last:start], "{"+group+"}")
+		last = end
+	}
+
+	if result.tags != nil {
+		result.name = strings.Join(append(name, key[last:]), "")
+	}
+
+	return true, result
+}
+
+// split matches every metric key of a single instance against all the filters at once and returns,
+// for each of the filters, metrics it has matched
+func (fs Filters) split(metrics SimpleMetrics) []matchedMetrics {
+	result := make([]matchedMetrics, len(fs))
+	byGroup := map[string][]int{}
+	for i, f := range fs {
+		result[i] = matchedMetrics{
+			SimpleMetrics: SimpleMetrics{
+				Service: metrics.Service,
+				Metrics: PandoraMetrics{
+					Gauges: map[string]PandoraGauge{},
+					Meters: map[string]PandoraMeter{},
+					Timers: map[string]PandoraTimer{},
+				},
+			},
+			keys: map[string]metricKey{},
+		}
+		byGroup[f.Group] = append(byGroup[f.Group], i)
+	}
+
+	for k, v := range metrics.Metrics.Gauges {
+		for _, i := range byGroup[filterGauge] {
+			if match, key := fs[i].match(k); match {
+				result[i].Metrics.Gauges[k] = v
+				result[i].keys[k] = key
+			}
+		}
+	}
+	for k, v := range metrics.Metrics.Meters {
+		for _, i := range byGroup[filterMeter] {
+			if match, key := fs[i].match(k); match {
+				result[i].Metrics.Meters[k] = v
+				result[i].keys[k] = key
+			}
+		}
+	}
+	for k, v := range metrics.Metrics.Timers {
+		for _, i := range byGroup[filterTimer] {
+			if match, key := fs[i].match(k); match {
+				result[i].Metrics.Timers[k] = v
+				result[i].keys[k] = key
+			}
+		}
+	}
+
+	return result
+}
+
+// Combine filters metrics of all the instances of a service: per instance metrics (ParseSingle) are followed
+// by the service aggregates (ParseMany) for every filter emitting them
+func (fs Filters) Combine(serviceName string, metrics []SimpleMetrics) []FilteredMetrics {
+	return fs.CombineAll(GroupedMetrics{serviceName: metrics})
+}
+
+// CombineAll filters metrics of all the services at once, so the aggregates can be grouped across the services
+func (fs Filters) CombineAll(serviceMetrics GroupedMetrics) []FilteredMetrics {
+	results, _ := fs.CombineLimited(serviceMetrics)
+
+	return results
+}
+
+// CombineLimited is CombineAll returning also numbers of series dropped over max_series of the filters by path
+func (fs Filters) CombineLimited(serviceMetrics GroupedMetrics) ([]FilteredMetrics, map[string]int) {
+	results := []FilteredMetrics{}
+	dropped := map[string]int{}
+
+	serviceNames := make([]string, 0, len(serviceMetrics))
+	for serviceName := range serviceMetrics {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	matched := make([][]matchedMetrics, len(fs))
+	for _, serviceName := range serviceNames {
+		for _, metric := range serviceMetrics[serviceName] {
+			for i, m := range fs.split(metric) {
+				m.serviceName = serviceName
+				matched[i] = append(matched[i], m)
+			}
+		}
+	}
+
+	for i, f := range fs {
+		filtered := []FilteredMetrics{}
+		if f.emits(emitInstance) {
+			for _, m := range matched[i] {
+				filtered = append(filtered, f.parseSingle(m)...)
+			}
+		}
+		if f.emits(emitAggregate) {
+			filtered = append(filtered, f.parseMany(matched[i])...)
+		}
+
+		filtered, count := LimitSeries(filtered, f.MaxSeries)
+		if count != 0 {
+			log.WithFields(log.Fields{"path": f.Path, "dropped": count}).Warn("Filter exceeded max_series - dropping series")
+			dropped[f.Path] += count
+		}
+		results = append(results, filtered...)
+	}
+
+	return results, dropped
+}
+
+// instanceTags returns tags of a per instance metric
+func instanceTags(key metricKey, serviceInfo ServiceInfo) map[string]string {
+	tags := map[string]string{}
+	for k, v := range serviceInfo.Tags {
+		tags[k] = v
+	}
+	for k, v := range key.tags {
+		tags[k] = v
+	}
+	tags["service_name"] = serviceInfo.Name
+	tags["host"] = serviceInfo.Host
+	tags["metric_name"] = key.name
+
+	return tags
+}
+
+// groupTags returns tags of an aggregated metric, key is the group key
+func groupTags(key metricKey) map[string]string {
+	tags := map[string]string{}
+	for k, v := range key.tags {
+		tags[k] = v
+	}
+	tags["metric_name"] = key.name
+
+	return tags
+}
+
+func (f Filter) parseGauge(key metricKey, serviceInfo ServiceInfo, metric PandoraGauge) FilteredMetrics {
+	log.Debugf("Found gauge metric %s : %s", key.name, metric)
+	finalMetric := NewFilteredMetric()
+	finalMetric.Tags = instanceTags(key, serviceInfo)
 	finalMetric.Fields["value"] = metric.Parse()
 	finalMetric.Fields["service_id"] = serviceInfo.ID
 
-	return finalMetric
+	return f.finalize(finalMetric, key, serviceInfo.Name, false)
 }
 
-func (f Filter) parseMeter(key string, serviceInfo ServiceInfo, metric PandoraMeter) FilteredMetrics {
-	log.Debugf("Found meter metric %s : %s", key, metric)
+func (f Filter) parseMeter(key metricKey, serviceInfo ServiceInfo, metric PandoraMeter) FilteredMetrics {
+	log.Debugf("Found meter metric %s : %s", key.name, metric)
 	finalMetric := NewFilteredMetric()
-	finalMetric.Measurement = f.Measurement
 	finalMetric.Fields["value"] = metric.Count
-	finalMetric.Fields["m1_rate"] = metric.M1Rate
-	finalMetric.Fields["service_id"] = serviceInfo.ID
-	finalMetric.Tags = map[string]string{
-		"service_name": serviceInfo.Name,
-		"host":         serviceInfo.Host,
-		"metric_name":  key,
+	if !metric.CountOnly {
+		finalMetric.Fields["m1_rate"] = metric.M1Rate
+	}
+	if metric.Rate != nil {
+		finalMetric.Fields["rate"] = *metric.Rate
 	}
+	finalMetric.Fields["service_id"] = serviceInfo.ID
+	finalMetric.Tags = instanceTags(key, serviceInfo)
 
-	return finalMetric
+	return f.finalize(finalMetric, key, serviceInfo.Name, false)
 }
 
-func (f Filter) parseTimer(key string, serviceInfo ServiceInfo, metric PandoraTimer) FilteredMetrics {
-	log.Debugf("Found timer metric %s : %s", key, metric)
+func (f Filter) parseTimer(key metricKey, serviceInfo ServiceInfo, metric PandoraTimer) FilteredMetrics {
+	log.Debugf("Found timer metric %s : %s", key.name, metric)
 	finalMetric := NewFilteredMetric()
-	finalMetric.Measurement = f.Measurement
 	finalMetric.Fields["value"] = metric.Count
-	finalMetric.Fields["m1_rate"] = metric.M1Rate
-	finalMetric.Fields["p50"] = metric.P50
-	finalMetric.Fields["p99"] = metric.P99
-	finalMetric.Fields["service_id"] = serviceInfo.ID
-	finalMetric.Tags = map[string]string{
-		"service_name": serviceInfo.Name,
-		"host":         serviceInfo.Host,
-		"metric_name":  key,
+	if !metric.CountOnly {
+		finalMetric.Fields["m1_rate"] = metric.M1Rate
+		finalMetric.Fields["p50"] = metric.P50
+		finalMetric.Fields["p99"] = metric.P99
 	}
+	if metric.Rate != nil {
+		finalMetric.Fields["rate"] = *metric.Rate
+	}
+	finalMetric.Fields["service_id"] = serviceInfo.ID
+	finalMetric.Tags = instanceTags(key, serviceInfo)
 
-	return finalMetric
+	return f.finalize(finalMetric, key, serviceInfo.Name, false)
 }
 
-func (f Filter) averageGauges(key string, serviceName string, gauges []PandoraGauge) FilteredMetrics {
+func (f Filter) averageGauges(key metricKey, gauges []PandoraGauge) FilteredMetrics {
 	finalMetric := NewFilteredMetric()
 
 	if len(gauges) == 0 {
 		return finalMetric
 	}
 
-	finalMetric.Measurement = "metric_graphs"
-	finalMetric.Tags = map[string]string{
-		"service_name": serviceName,
-		"metric_name":  key,
+	finalMetric.Tags = groupTags(key)
+
+	if len(f.Aggregations) != 0 {
+		instances := make([]map[string]float64, len(gauges))
+		for i, gauge := range gauges {
+			instances[i] = map[string]float64{"value": gauge.Parse()}
+		}
+		return f.finalize(f.aggregate(finalMetric, instances), key, key.tags[dimensionServiceName], true)
 	}
 
 	var sum, min, max float64
@@ -120,53 +720,88 @@ func (f Filter) averageGauges(key string, serviceName string, gauges []PandoraGa
 	finalMetric.Fields["sum"] = sum
 	finalMetric.Fields["avg"] = sum / float64(len(gauges))
 
-	return finalMetric
+	return f.finalize(finalMetric, key, key.tags[dimensionServiceName], true)
 }
 
-func (f Filter) averageMeters(key string, serviceName string, meters []PandoraMeter) FilteredMetrics {
+func (f Filter) averageMeters(key metricKey, meters []PandoraMeter) FilteredMetrics {
 	finalMetric := NewFilteredMetric()
 
 	if len(meters) == 0 {
 		return finalMetric
 	}
 
-	finalMetric.Measurement = "metric_graphs"
-	finalMetric.Tags = map[string]string{
-		"service_name": serviceName,
-		"metric_name":  key,
+	finalMetric.Tags = groupTags(key)
+
+	if len(f.Aggregations) != 0 {
+		instances := make([]map[string]float64, len(meters))
+		for i, meter := range meters {
+			instances[i] = map[string]float64{"value": float64(meter.Count)}
+			if !meter.CountOnly {
+				instances[i]["m1_rate"] = meter.M1Rate
+			}
+		}
+		return f.finalize(f.aggregate(finalMetric, instances), key, key.tags[dimensionServiceName], true)
 	}
 
 	var sum uint64
 	var m1RateSum float64
+	countOnly := false
+	rates := []float64{}
 	for _, meter := range meters {
 		sum = sum + meter.Count
 		m1RateSum = m1RateSum + meter.M1Rate
+		countOnly = countOnly || meter.CountOnly
+		if meter.Rate != nil {
+			rates = append(rates, *meter.Rate)
+		}
 	}
 
 	finalMetric.Fields["count"] = len(meters)
-	finalMetric.Fields["m1_rate"] = m1RateSum
+	if !countOnly {
+		finalMetric.Fields["m1_rate"] = m1RateSum
+	}
 	finalMetric.Fields["value"] = sum
+	// a sum of some of the instances would under-report, e.g. right after a restart
+	if len(rates) == len(meters) {
+		finalMetric.Fields["rate"] = sumValues(rates)
+	}
 
-	return finalMetric
+	return f.finalize(finalMetric, key, key.tags[dimensionServiceName], true)
 }
 
-func (f Filter) averageTimers(key string, serviceName string, timers []PandoraTimer) FilteredMetrics {
+func (f Filter) averageTimers(key metricKey, timers []PandoraTimer) FilteredMetrics {
 	finalMetric := NewFilteredMetric()
 
 	if len(timers) == 0 {
 		return finalMetric
 	}
 
-	finalMetric.Measurement = "metric_graphs"
-	finalMetric.Tags = map[string]string{
-		"service_name": serviceName,
-		"metric_name":  key,
+	finalMetric.Tags = groupTags(key)
+
+	instances := make([]map[string]float64, len(timers))
+	countOnly := false
+	for i, timer := range timers {
+		instances[i] = map[string]float64{"value": float64(timer.Count)}
+		if timer.CountOnly {
+			countOnly = true
+			continue
+		}
+		instances[i]["m1_rate"] = timer.M1Rate
+		instances[i]["p50"] = timer.P50
+		instances[i]["p99"] = timer.P99
+	}
+	if len(f.Aggregations) != 0 {
+		return f.finalize(f.aggregate(finalMetric, instances), key, key.tags[dimensionServiceName], true)
 	}
 
 	var sum uint64
 	var m1Min, m1Max, m1Avg, p50Min, p50Max, p50Avg, p99Min, p99Max, p99Avg float64
+	rates := []float64{}
 	for i, timer := range timers {
 		sum = sum + timer.Count
+		if timer.Rate != nil {
+			rates = append(rates, *timer.Rate)
+		}
 
 		if i == 0 {
 			m1Min = timer.M1Rate
@@ -209,52 +844,65 @@ func (f Filter) averageTimers(key string, serviceName string, timers []PandoraTi
 		p50Avg = p50Avg + timer.P50
 		p99Avg = p99Avg + timer.P99
 	}
+	p50Avg = p50Avg / float64(len(timers))
+	p99Avg = p99Avg / float64(len(timers))
+
+	// busy instances have more impact on the fleet percentiles
+	if weights := f.weights(instances); weights != nil {
+		p50s := make([]float64, len(timers))
+		p99s := make([]float64, len(timers))
+		for i, timer := range timers {
+			p50s[i] = timer.P50
+			p99s[i] = timer.P99
+		}
+		p50Avg = weightedAvgValues(p50s, weights)
+		p99Avg = weightedAvgValues(p99s, weights)
+	}
 
 	finalMetric.Fields["count"] = len(timers)
 	finalMetric.Fields["sum"] = sum
 	finalMetric.Fields["avg"] = float64(sum) / float64(len(timers))
-	finalMetric.Fields["m1_min"] = m1Min
-	finalMetric.Fields["m1_max"] = m1Max
-	finalMetric.Fields["m1_avg"] = m1Avg / float64(len(timers))
-	finalMetric.Fields["p50_min"] = p50Min
-	finalMetric.Fields["p50_max"] = p50Max
-	finalMetric.Fields["p50_avg"] = p50Avg / float64(len(timers))
-	finalMetric.Fields["p99_min"] = p99Min
-	finalMetric.Fields["p99_max"] = p99Max
-	finalMetric.Fields["p99_avg"] = p99Avg / float64(len(timers))
+	// rates and percentiles are emitted only when all the instances expose them
+	if !countOnly {
+		finalMetric.Fields["m1_min"] = m1Min
+		finalMetric.Fields["m1_max"] = m1Max
+		finalMetric.Fields["m1_avg"] = m1Avg / float64(len(timers))
+		finalMetric.Fields["p50_min"] = p50Min
+		finalMetric.Fields["p50_max"] = p50Max
+		finalMetric.Fields["p50_avg"] = p50Avg
+		finalMetric.Fields["p99_min"] = p99Min
+		finalMetric.Fields["p99_max"] = p99Max
+		finalMetric.Fields["p99_avg"] = p99Avg
+	}
+	if len(rates) == len(timers) {
+		finalMetric.Fields["rate"] = sumValues(rates)
+	}
 
-	return finalMetric
+	return f.finalize(finalMetric, key, key.tags[dimensionServiceName], true)
 }
 
 // ParseSingle will parse and filter single metric
 func (f Filter) ParseSingle(metrics SimpleMetrics) []FilteredMetrics {
+	return f.parseSingle(Filters{f}.split(metrics)[0])
+}
+
+// parseSingle parses metrics already matched by the filter
+func (f Filter) parseSingle(metrics matchedMetrics) []FilteredMetrics {
 	results := []FilteredMetrics{}
 	log.Debugf("Filtering for %v", f)
 
 	switch f.Group {
 	case filterGauge:
 		for k, v := range metrics.Metrics.Gauges {
-			if match, _ := f.match(k); !match {
-				continue
-			}
-
-			results = append(results, f.parseGauge(k, metrics.Service, v))
+			results = append(results, f.parseGauge(metrics.keys[k], metrics.Service, v))
 		}
 	case filterMeter:
 		for k, v := range metrics.Metrics.Meters {
-			if match, _ := f.match(k); !match {
-				continue
-			}
-
-			results = append(results, f.parseMeter(k, metrics.Service, v))
+			results = append(results, f.parseMeter(metrics.keys[k], metrics.Service, v))
 		}
 	case filterTimer:
 		for k, v := range metrics.Metrics.Timers {
-			if match, _ := f.match(k); !match {
-				continue
-			}
-
-			results = append(results, f.parseTimer(k, metrics.Service, v))
+			results = append(results, f.parseTimer(metrics.keys[k], metrics.Service, v))
 		}
 	default:
 		log.Errorf("Unknown filter group: %s", f.Group)
@@ -265,51 +913,61 @@ func (f Filter) ParseSingle(metrics SimpleMetrics) []FilteredMetrics {
 
 // ParseMany will try to parse end group metrics
 func (f Filter) ParseMany(serviceName string, metrics []SimpleMetrics) []FilteredMetrics {
+	matched := make([]matchedMetrics, len(metrics))
+	for i, metric := range metrics {
+		matched[i] = Filters{f}.split(metric)[0]
+		matched[i].serviceName = serviceName
+	}
+
+	return f.parseMany(matched)
+}
+
+// parseMany aggregates metrics already matched by the filter, metrics are grouped by their name
+// and the grouping dimensions (service name and values of the named captures by default)
+func (f Filter) parseMany(metrics []matchedMetrics) []FilteredMetrics {
 	results := []FilteredMetrics{}
 	log.Debugf("Groupping for %v", f)
 
+	keys := map[string]metricKey{}
 	switch f.Group {
 	case filterGauge:
 		gauges := map[string][]PandoraGauge{}
 		for _, metric := range metrics {
 			for k, v := range metric.Metrics.Gauges {
-				if match, _ := f.match(k); !match {
-					continue
-				}
-
-				gauges[k] = append(gauges[k], v)
+				key := f.groupKey(metric.keys[k], metric)
+				id := key.id()
+				keys[id] = key
+				gauges[id] = append(gauges[id], v)
 			}
 		}
-		for k, v := range gauges {
-			results = append(results, f.averageGauges(k, serviceName, v))
+		for id, v := range gauges {
+			results = append(results, f.averageGauges(keys[id], v))
 		}
 	case filterMeter:
 		meters := map[string][]PandoraMeter{}
 		for _, metric := range metrics {
 			for k, v := range metric.Metrics.Meters {
-				if match, _ := f.match(k); !match {
-					continue
-				}
-
-				meters[k] = append(meters[k], v)
+				key := f.groupKey(metric.keys[k], metric)
+				id := key.id()
+				keys[id] = key
+				meters[id] = append(meters[id], v)
 			}
 		}
-		for k, v := range meters {
-			results = append(results, f.averageMeters(k, serviceName, v))
+		for id, v := range meters {
+			results = append(results, f.averageMeters(keys[id], v))
 		}
 	case filterTimer:
 		timers := map[string][]PandoraTimer{}
 		for _, metric := range metrics {
 			for k, v := range metric.Metrics.Timers {
-				if match, _ := f.match(k); !match {
-					continue
-				}
-
-				timers[k] = append(timers[k], v)
+				key := f.groupKey(metric.keys[k], metric)
+				id := key.id()
+				keys[id] = key
+				timers[id] = append(timers[id], v)
 			}
 		}
-		for k, v := range timers {
-			results = append(results, f.averageTimers(k, serviceName, v))
+		for id, v := range timers {
+			results = append(results, f.averageTimers(keys[id], v))
 		}
 	default:
 		log.Errorf("Unknown filter group: %s", f.Group)
@@ -1,6 +1,8 @@
 package models_test
 
 import (
+	"fmt"
+
 	. "github.com/Wikia/metrics-fetcher/models"
 
 	. "github.com/onsi/ginkgo"
@@ -106,6 +108,58 @@ var _ = Describe("Filter", func() {
 			},
 		},
 	}
+	Describe("NewFilters()", func() {
+		It("Should compile valid filters", func() {
+			filters, err := NewFilters([]Filter{
+				{Group: "gauges", Path: "^some\\.very"},
+				{Group: "timers", Path: "timer_.*"},
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(2))
+		})
+
+		It("Should reject invalid patterns", func() {
+			_, err := NewFilters([]Filter{{Group: "gauges", Path: "some.(very"}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should skip unknown groups", func() {
+			filters, err := NewFilters([]Filter{
+				{Group: "histograms", Path: "some"},
+				{Group: "gauges", Path: "some"},
+			})
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filters).To(HaveLen(1))
+			Expect(filters[0].Group).To(Equal("gauges"))
+		})
+	})
+
+	Describe("Filters.Combine()", func() {
+		It("Should match every filter and aggregate per filter", func() {
+			filters, err := NewFilters([]Filter{
+				{Group: "gauges", Path: "^some\\.very\\.custom_Path$", Measurement: "test-measurement"},
+				{Group: "gauges", Path: "custom_Path", Measurement: "other-measurement"},
+				{Group: "meters", Path: "^some\\.very\\.custom_Path2$", Measurement: "test-measurement"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := filters.Combine("test-service", metrics)
+
+			expected := []FilteredMetrics{}
+			for _, filter := range filters {
+				for _, metric := range metrics {
+					expected = append(expected, filter.ParseSingle(metric)...)
+				}
+				expected = append(expected, filter.ParseMany("test-service", metrics)...)
+			}
+
+			Expect(result).To(HaveLen(2 + 1 + 6 + 3 + 2 + 1))
+			Expect(result).To(ConsistOf(expected))
+		})
+	})
+
 	Describe("ParseSingle()", func() {
 		Context("With simple gauge matching filter", func() {
 			filter := Filter{
@@ -126,6 +180,7 @@ var _ = Describe("Filter", func() {
 						"value":      float64(1234),
 						"service_id": "123-45-67-89",
 					},
+					Group: "gauges",
 				},
 			}
 
@@ -157,6 +212,7 @@ var _ = Describe("Filter", func() {
 						"m1_rate":    float64(2.0),
 						"service_id": "123-45-67-89",
 					},
+					Group: "meters",
 				},
 			}
 
@@ -190,6 +246,7 @@ var _ = Describe("Filter", func() {
 						"m1_rate":    float64(3.14),
 						"service_id": "123-45-67-89",
 					},
+					Group: "timers",
 				},
 			}
 
@@ -220,6 +277,7 @@ var _ = Describe("Filter", func() {
 						"value":      float64(683),
 						"service_id": "123-45-67-89",
 					},
+					Group: "gauges",
 				},
 			}
 
@@ -250,6 +308,7 @@ var _ = Describe("Filter", func() {
 						"value":      float64(1234),
 						"service_id": "123-45-67-89",
 					},
+					Group: "gauges",
 				},
 				{
 					Measurement: "test-measurement",
@@ -262,6 +321,7 @@ var _ = Describe("Filter", func() {
 						"value":      float64(7532),
 						"service_id": "123-45-67-89",
 					},
+					Group: "gauges",
 				},
 				{
 					Measurement: "test-measurement",
@@ -274,6 +334,7 @@ var _ = Describe("Filter", func() {
 						"value":      float64(895),
 						"service_id": "123-45-67-89",
 					},
+					Group: "gauges",
 				},
 			}
 
@@ -286,6 +347,325 @@ var _ = Describe("Filter", func() {
 		})
 	})
 
+	Describe("Named capture groups", func() {
+		poolMetrics := []SimpleMetrics{
+			{
+				Service: ServiceInfo{Name: "test-service", ID: "1", Host: "localhost"},
+				Metrics: PandoraMetrics{
+					Gauges: map[string]PandoraGauge{
+						"jvm.memory.pools.Metaspace.usage":  {Value: []byte("0.5")},
+						"jvm.memory.pools.PS-Old-Gen.usage": {Value: []byte("0.25")},
+						"jvm.memory.heap.usage":             {Value: []byte("0.1")},
+					},
+				},
+			},
+			{
+				Service: ServiceInfo{Name: "test-service", ID: "2", Host: "localhost2"},
+				Metrics: PandoraMetrics{
+					Gauges: map[string]PandoraGauge{
+						"jvm.memory.pools.Metaspace.usage":  {Value: []byte("0.7")},
+						"jvm.memory.pools.PS-Old-Gen.usage": {Value: []byte("0.75")},
+					},
+				},
+			},
+		}
+		filter := Filter{
+			Group:       "gauges",
+			Path:        "^jvm\\.memory\\.pools\\.(?P<pool>.*)\\.usage$",
+			Measurement: "jvm_memory",
+		}
+
+		It("ParseSingle() should add captures as tags", func() {
+			result := filter.ParseSingle(poolMetrics[0])
+
+			Expect(result).To(ConsistOf([]FilteredMetrics{
+				{
+					Measurement: "jvm_memory",
+					Tags: map[string]string{
+						"service_name": "test-service",
+						"host":         "localhost",
+						"metric_name":  "jvm.memory.pools.{pool}.usage",
+						"pool":         "Metaspace",
+					},
+					Fields: map[string]interface{}{"value": 0.5, "service_id": "1"},
+					Group:  "gauges",
+				},
+				{
+					Measurement: "jvm_memory",
+					Tags: map[string]string{
+						"service_name": "test-service",
+						"host":         "localhost",
+						"metric_name":  "jvm.memory.pools.{pool}.usage",
+						"pool":         "PS-Old-Gen",
+					},
+					Fields: map[string]interface{}{"value": 0.25, "service_id": "1"},
+					Group:  "gauges",
+				},
+			}))
+		})
+
+		It("ParseMany() should aggregate per captured value", func() {
+			result := filter.ParseMany("test-service", poolMetrics)
+
+			Expect(result).To(ConsistOf([]FilteredMetrics{
+				{
+					Measurement: "metric_graphs",
+					Tags: map[string]string{
+						"service_name": "test-service",
+						"metric_name":  "jvm.memory.pools.{pool}.usage",
+						"pool":         "Metaspace",
+					},
+					Fields: map[string]interface{}{"count": 2, "min": 0.5, "max": 0.7, "sum": 1.2, "avg": 0.6},
+					Group:  "gauges",
+				},
+				{
+					Measurement: "metric_graphs",
+					Tags: map[string]string{
+						"service_name": "test-service",
+						"metric_name":  "jvm.memory.pools.{pool}.usage",
+						"pool":         "PS-Old-Gen",
+					},
+					Fields: map[string]interface{}{"count": 2, "min": 0.25, "max": 0.75, "sum": 1.0, "avg": 0.5},
+					Group:  "gauges",
+				},
+			}))
+		})
+
+		It("Should replace only named captures in the metric name", func() {
+			dbFilter := Filter{
+				Group: "gauges",
+				Path:  "^jvm\\.memory\\.(pools)\\.(?P<pool>[^.]*)\\.(?P<kind>usage)$",
+			}
+
+			result := dbFilter.ParseSingle(poolMetrics[1])
+			Expect(result).To(HaveLen(2))
+			for _, metric := range result {
+				Expect(metric.Tags["metric_name"]).To(Equal("jvm.memory.pools.{pool}.{kind}"))
+				Expect(metric.Tags["kind"]).To(Equal("usage"))
+			}
+		})
+	})
+
+	Describe("Templates", func() {
+		metric := SimpleMetrics{
+			Service: ServiceInfo{Name: "test-service", ID: "1", Host: "localhost"},
+			Metrics: PandoraMetrics{
+				Gauges: map[string]PandoraGauge{
+					"jvm.memory.pools.Metaspace.usage": {Value: []byte("0.5")},
+				},
+			},
+		}
+
+		It("Should render measurement, metric_name and fields", func() {
+			filters, err := NewFilters([]Filter{
+				{
+					Group:                "gauges",
+					Path:                 "^jvm\\.memory\\.pools\\.(?P<pool>.*)\\.usage$",
+					Measurement:          "jvm_{{.pool}}",
+					AggregateMeasurement: "{{.service_name}}_{{.group}}",
+					MetricName:           "pool_usage",
+					Fields:               map[string]string{"value": "{{.pool}}_usage", "avg": "usage_avg"},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := filters.Combine("test-service", []SimpleMetrics{metric})
+
+			Expect(result).To(ConsistOf([]FilteredMetrics{
+				{
+					Measurement: "jvm_Metaspace",
+					Tags: map[string]string{
+						"service_name": "test-service",
+						"host":         "localhost",
+						"metric_name":  "pool_usage",
+						"pool":         "Metaspace",
+					},
+					Fields:  map[string]interface{}{"Metaspace_usage": 0.5, "service_id": "1"},
+					Group:   "gauges",
+					Renamed: map[string]string{"Metaspace_usage": "value"},
+				},
+				{
+					Measurement: "test-service_gauges",
+					Tags: map[string]string{
+						"service_name": "test-service",
+						"metric_name":  "pool_usage",
+						"pool":         "Metaspace",
+					},
+					Fields:  map[string]interface{}{"count": 1, "min": 0.5, "max": 0.5, "sum": 0.5, "usage_avg": 0.5},
+					Group:   "gauges",
+					Renamed: map[string]string{"usage_avg": "avg"},
+				},
+			}))
+		})
+
+		It("Should swap and chain renamed fields", func() {
+			filters, err := NewFilters([]Filter{
+				{Group: "timers", Path: "swapped", Fields: map[string]string{"p50": "p99", "p99": "p50"}, Emit: []string{"instance"}},
+				{Group: "timers", Path: "chained", Fields: map[string]string{"p50": "p99", "p99": "p999"}, Emit: []string{"instance"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			timer := PandoraTimer{Count: 3, P50: 0.1, P99: 0.9, M1Rate: 1.5}
+			timers := SimpleMetrics{
+				Service: ServiceInfo{Name: "test-service", ID: "1", Host: "localhost"},
+				Metrics: PandoraMetrics{Timers: map[string]PandoraTimer{"swapped": timer, "chained": timer}},
+			}
+
+			for i := 0; i < 10; i++ {
+				result := filters.Combine("test-service", []SimpleMetrics{timers})
+
+				Expect(result).To(HaveLen(2))
+				for _, metric := range result {
+					if metric.Tags["metric_name"] == "swapped" {
+						Expect(metric.Fields).To(Equal(map[string]interface{}{"value": uint64(3), "m1_rate": 1.5, "p50": 0.9, "p99": 0.1, "service_id": "1"}))
+					} else {
+						Expect(metric.Fields).To(Equal(map[string]interface{}{"value": uint64(3), "m1_rate": 1.5, "p99": 0.1, "p999": 0.9, "service_id": "1"}))
+					}
+				}
+			}
+		})
+
+		It("Should reject colliding renamed fields", func() {
+			_, err := NewFilters([]Filter{{Group: "timers", Path: "jvm", Fields: map[string]string{"p50": "latency", "p99": "latency"}}})
+			Expect(err).To(HaveOccurred())
+
+			_, err = NewFilters([]Filter{{Group: "timers", Path: "jvm", Fields: map[string]string{"p50": "p99"}}})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should reject invalid templates", func() {
+			_, err := NewFilters([]Filter{{Group: "gauges", Path: "jvm", Measurement: "jvm_{{.pool"}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("GroupBy", func() {
+		instance := func(service string, id string, host string, zone string, pool string, value string) SimpleMetrics {
+			return SimpleMetrics{
+				Service: ServiceInfo{Name: service, ID: id, Host: host, Labels: map[string]string{"zone": zone}},
+				Metrics: PandoraMetrics{Gauges: map[string]PandoraGauge{"jvm.memory.pools." + pool + ".usage": {Value: []byte(value)}}},
+			}
+		}
+		grouped := GroupedMetrics{
+			"service-a": {
+				instance("service-a", "1", "host-1", "us-east", "Metaspace", "1"),
+				instance("service-a", "2", "host-2", "us-west", "Metaspace", "2"),
+				instance("service-a", "2", "host-2", "us-west", "Eden", "4"),
+			},
+			"service-b": {
+				instance("service-b", "3", "host-1", "us-east", "Metaspace", "8"),
+			},
+		}
+		sums := func(result []FilteredMetrics) map[string]interface{} {
+			sums := map[string]interface{}{}
+			for _, metric := range result {
+				delete(metric.Tags, "metric_name")
+				sums[fmt.Sprint(metric.Tags)] = metric.Fields["sum"]
+			}
+			return sums
+		}
+
+		It("Should group by service name and named captures by default", func() {
+			filters, _ := NewFilters([]Filter{{Group: "gauges", Path: "^jvm\\.memory\\.pools\\.(?P<pool>.*)\\.usage$", Emit: []string{"aggregate"}}})
+
+			Expect(sums(filters.CombineAll(grouped))).To(Equal(map[string]interface{}{
+				"map[pool:Eden service_name:service-a]":      4.0,
+				"map[pool:Metaspace service_name:service-a]": 3.0,
+				"map[pool:Metaspace service_name:service-b]": 8.0,
+			}))
+		})
+
+		It("Should group by host and labels across the services", func() {
+			filters, _ := NewFilters([]Filter{
+				{Group: "gauges", Path: "^jvm\\.memory\\.pools\\.(?P<pool>.*)\\.usage$", Emit: []string{"aggregate"}, GroupBy: []string{"host", "pool"}},
+			})
+
+			Expect(sums(filters.CombineAll(grouped))).To(Equal(map[string]interface{}{
+				"map[host:host-1 pool:Metaspace]": 9.0,
+				"map[host:host-2 pool:Eden]":      4.0,
+				"map[host:host-2 pool:Metaspace]": 2.0,
+			}))
+
+			filters, _ = NewFilters([]Filter{
+				{Group: "gauges", Path: "^jvm\\.memory\\.pools\\.(?P<pool>.*)\\.usage$", Emit: []string{"aggregate"}, GroupBy: []string{"service_name", "zone"}},
+			})
+
+			Expect(sums(filters.CombineAll(grouped))).To(Equal(map[string]interface{}{
+				"map[service_name:service-a zone:us-east]": 1.0,
+				"map[service_name:service-a zone:us-west]": 6.0,
+				"map[service_name:service-b zone:us-east]": 8.0,
+			}))
+		})
+
+		It("Should aggregate the whole fleet", func() {
+			filters, _ := NewFilters([]Filter{
+				{Group: "gauges", Path: "^jvm\\.memory\\.pools\\.(?P<pool>.*)\\.usage$", Emit: []string{"aggregate"}, GroupBy: []string{"metric_name"}},
+			})
+
+			result := filters.CombineAll(grouped)
+
+			Expect(result).To(HaveLen(1))
+			Expect(result[0].Tags).To(Equal(map[string]string{"metric_name": "jvm.memory.pools.{pool}.usage"}))
+			Expect(result[0].Fields["sum"]).To(Equal(15.0))
+			Expect(result[0].Fields["count"]).To(Equal(4))
+		})
+
+		It("Should add service tags to instance metrics and aggregates", func() {
+			tagged := GroupedMetrics{}
+			for name, metrics := range grouped {
+				for _, metric := range metrics {
+					metric.Service.Tags = map[string]string{"env": "prod", "app": name}
+					tagged[name] = append(tagged[name], metric)
+				}
+			}
+			filters, _ := NewFilters([]Filter{{Group: "gauges", Path: "^jvm\\.memory\\.pools\\.Eden\\.usage$"}})
+
+			result := filters.CombineAll(tagged)
+
+			Expect(result).To(HaveLen(2))
+			Expect(result[0].Tags).To(HaveKeyWithValue("env", "prod"))
+			Expect(result[0].Tags).To(HaveKeyWithValue("host", "host-2"))
+			Expect(result[1].Tags).To(Equal(map[string]string{
+				"env":          "prod",
+				"app":          "service-a",
+				"service_name": "service-a",
+				"metric_name":  "jvm.memory.pools.Eden.usage",
+			}))
+
+			filters, _ = NewFilters([]Filter{
+				{Group: "gauges", Path: "^jvm\\.memory\\.pools\\.(?P<pool>.*)\\.usage$", Emit: []string{"aggregate"}, GroupBy: []string{"env"}},
+			})
+			Expect(sums(filters.CombineAll(tagged))).To(Equal(map[string]interface{}{"map[env:prod]": 15.0}))
+		})
+
+		It("Should reject empty dimensions", func() {
+			_, err := NewFilters([]Filter{{Group: "gauges", Path: "jvm", GroupBy: []string{""}}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Emit", func() {
+		It("Should produce only selected kinds of metrics", func() {
+			filters, err := NewFilters([]Filter{
+				{Group: "gauges", Path: "^some\\.very\\.custom_Path$", Measurement: "instances", Emit: []string{"instance"}},
+				{Group: "meters", Path: "^some\\.very\\.custom_Path$", Measurement: "aggregates", Emit: []string{"aggregate"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := filters.Combine("test-service", metrics)
+
+			Expect(result).To(HaveLen(3))
+			Expect(result[0].Measurement).To(Equal("instances"))
+			Expect(result[1].Measurement).To(Equal("instances"))
+			Expect(result[2].Measurement).To(Equal("metric_graphs"))
+			Expect(result[2].Tags).NotTo(HaveKey("host"))
+		})
+
+		It("Should reject unknown options", func() {
+			_, err := NewFilters([]Filter{{Group: "gauges", Path: "some", Emit: []string{"all"}}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Describe("ParseMany()", func() {
 		Context("With simple gauge matching filter", func() {
 			filter := Filter{
@@ -308,6 +688,7 @@ var _ = Describe("Filter", func() {
 						"sum":   float64(1776),
 						"count": 2,
 					},
+					Group: "gauges",
 				},
 			}
 
@@ -338,6 +719,7 @@ var _ = Describe("Filter", func() {
 						"m1_rate": float64(2.0),
 						"count":   2,
 					},
+					Group: "meters",
 				},
 			}
 
@@ -377,6 +759,7 @@ var _ = Describe("Filter", func() {
 						"m1_max":  float64(4.904),
 						"count":   2,
 					},
+					Group: "timers",
 				},
 			}
 
@@ -388,4 +771,38 @@ var _ = Describe("Filter", func() {
 			})
 		})
 	})
+
+	Describe("Count only timers", func() {
+		countOnly := []SimpleMetrics{}
+		for i, count := range []uint64{4, 6} {
+			countOnly = append(countOnly, SimpleMetrics{
+				Service: ServiceInfo{Name: "test-service", ID: fmt.Sprint(i), Host: "localhost"},
+				Metrics: PandoraMetrics{
+					Timers: map[string]PandoraTimer{"http.server.requests": {Count: count, CountOnly: true}},
+				},
+			})
+		}
+		filter := Filter{Group: "timers", Path: "^http\\.server\\.requests$"}
+
+		It("Should leave out rates and percentiles", func() {
+			result := filter.ParseSingle(countOnly[0])
+
+			Expect(result).To(HaveLen(1))
+			Expect(result[0].Fields).To(Equal(map[string]interface{}{"value": uint64(4), "service_id": "0"}))
+
+			aggregate := filter.ParseMany("test-service", countOnly)
+			Expect(aggregate).To(HaveLen(1))
+			Expect(aggregate[0].Fields).To(Equal(map[string]interface{}{"count": 2, "sum": uint64(10), "avg": float64(5)}))
+		})
+
+		It("Should aggregate only the count", func() {
+			filter := Filter{Group: "timers", Path: "^http\\.server\\.requests$", Aggregations: map[string][]string{"value": {"sum"}, "p99": {"max"}}}
+			Expect(filter.Compile()).To(Succeed())
+
+			result := filter.ParseMany("test-service", countOnly)
+
+			Expect(result).To(HaveLen(1))
+			Expect(result[0].Fields).To(Equal(map[string]interface{}{"value_sum": float64(10)}))
+		})
+	})
 })
@@ -8,17 +8,37 @@ import (
 	"strings"
 )
 
+const defaultMetricsPath = "/metrics"
+
 // ServiceInfo holds basic information about a service
 type ServiceInfo struct {
 	Name string
 	ID   string
 	Host string
 	Port int64
+	// Format is the name of the input format metrics are exposed in (empty means Dropwizard)
+	Format string
+	// Path overrides the default path of the metrics endpoint
+	Path string
+	// Labels holds labels of the Marathon app, used as group_by dimensions
+	Labels map[string]string
+	// Tags are added to all the metrics of the service (e.g. decomposed Marathon app ID)
+	Tags map[string]string
 }
 
 // GetAddress returns the service address from which metrics are fetched
 func (s ServiceInfo) GetAddress() string {
-	return fmt.Sprintf("http://%s:%d/metrics", s.Host, s.Port)
+	return s.GetURL(defaultMetricsPath)
+}
+
+// GetURL returns the address of a service endpoint, defaultPath is used unless the service overrides it
+func (s ServiceInfo) GetURL(defaultPath string) string {
+	path := s.Path
+	if len(path) == 0 {
+		path = defaultPath
+	}
+
+	return fmt.Sprintf("http://%s:%d%s", s.Host, s.Port, path)
 }
 
 // SimpleMetrics represents very simple metric for Pandora service
@@ -48,6 +68,10 @@ func (pg PandoraGauge) Parse() float64 {
 type PandoraMeter struct {
 	Count  uint64
 	M1Rate float64 `json:"m1_rate"`
+	// Rate is the per second rate of Count since the previous run, nil when it is not known
+	Rate *float64 `json:"-"`
+	// CountOnly marks meters of inputs exposing only the count (e.g. Spring Boot), M1Rate isn't emitted for them
+	CountOnly bool `json:"-"`
 }
 
 func (pm PandoraMeter) String() string {
@@ -60,6 +84,11 @@ type PandoraTimer struct {
 	P50    float64
 	P99    float64
 	M1Rate float64 `json:"m1_rate"`
+	// Rate is the per second rate of Count since the previous run, nil when it is not known
+	Rate *float64 `json:"-"`
+	// CountOnly marks timers of inputs exposing only the count (e.g. Spring Boot), M1Rate, P50 and P99 aren't
+	// emitted for them
+	CountOnly bool `json:"-"`
 }
 
 func (pt PandoraTimer) String() string {
@@ -83,6 +112,21 @@ type FilteredMetrics struct {
 	Measurement string
 	Tags        map[string]string
 	Fields      map[string]interface{}
+	// Group is the Dropwizard group (gauges, meters or timers) of the filter producing the metric, empty for
+	// derived metrics. It isn't sent to InfluxDB.
+	Group string
+	// Renamed maps fields renamed by the filter to their original names, so the kind of a renamed field (e.g. the
+	// count of a meter) is still known. It isn't sent to InfluxDB.
+	Renamed map[string]string
+}
+
+// SourceField returns the name a field had before it was renamed by the filter
+func (fm FilteredMetrics) SourceField(field string) string {
+	if source, ok := fm.Renamed[field]; ok {
+		return source
+	}
+
+	return field
 }
 
 func (fm FilteredMetrics) String() string {
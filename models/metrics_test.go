@@ -18,6 +18,15 @@ var _ = Describe("Metrics", func() {
 		It("GetAddress() should return proper URI", func() {
 			Expect(service.GetAddress()).To(Equal("http://127.0.0.1:1234/metrics"))
 		})
+
+		It("GetURL() should prefer the path set on the service", func() {
+			Expect(service.GetURL("/debug/vars")).To(Equal("http://127.0.0.1:1234/debug/vars"))
+
+			custom := service
+			custom.Path = "/admin/metrics"
+			Expect(custom.GetURL("/debug/vars")).To(Equal("http://127.0.0.1:1234/admin/metrics"))
+			Expect(custom.GetAddress()).To(Equal("http://127.0.0.1:1234/admin/metrics"))
+		})
 	})
 
 	Describe("PandoraGauge", func() {
@@ -0,0 +1,299 @@
+package models
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-errors/errors"
+)
+
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelMap  = "labelmap"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+	relabelHashMod   = "hashmod"
+
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelSeparator   = ";"
+	defaultRelabelReplacement = "$1"
+
+	// LabelMeasurement is the label holding measurement name of filtered metrics during relabeling
+	LabelMeasurement = "__measurement__"
+	// LabelMarathonPrefix prefixes labels of Marathon apps during relabeling of services
+	LabelMarathonPrefix = "__label_"
+	// LabelTagPrefix prefixes tags of services during relabeling of services
+	LabelTagPrefix = "__tag_"
+	// labelInternalPrefix marks labels which are not kept as tags
+	labelInternalPrefix = "__"
+)
+
+// RelabelRule rewrites labels following Prometheus relabel_config semantics.
+//
+// Values of SourceLabels joined with Separator are matched against the anchored Regex. Actions:
+// replace (default) sets TargetLabel to the expanded Replacement (removes it when empty), keep/drop keep or drop
+// the whole target when the value (does not) match, labelmap copies labels with names matching Regex under names
+// given by Replacement, labeldrop/labelkeep remove labels with names (not) matching Regex (__measurement__ is
+// never removed) and hashmod sets TargetLabel to the hash of the value modulo Modulus.
+type RelabelRule struct {
+	SourceLabels []string `mapstructure:"source_labels"`
+	Separator    string
+	Regex        string
+	Modulus      uint64
+	TargetLabel  string `mapstructure:"target_label"`
+	// Replacement is $1 when unset, an empty replacement removes the target label
+	Replacement *string
+	Action      string
+
+	re          *regexp.Regexp
+	replacement string
+}
+
+// RelabelRules is a list of compiled relabel rules applied in order
+type RelabelRules []RelabelRule
+
+// Relabeling holds relabel rules of services (applied before scraping) and of filtered metrics (before output)
+type Relabeling struct {
+	Services []RelabelRule
+	Metrics  []RelabelRule
+}
+
+// NewRelabelRules compiles all the rules, invalid regexes and actions are rejected
+func NewRelabelRules(rules []RelabelRule) (RelabelRules, error) {
+	result := make(RelabelRules, len(rules))
+	for i, rule := range rules {
+		if rule.re == nil {
+			if err := rule.Compile(); err != nil {
+				return nil, err
+			}
+		}
+		result[i] = rule
+	}
+
+	return result, nil
+}
+
+// NewServiceRelabelRules compiles rules of services, rules setting host or port (the scrape address) are rejected
+func NewServiceRelabelRules(rules []RelabelRule) (RelabelRules, error) {
+	for _, rule := range rules {
+		if rule.TargetLabel == "host" || rule.TargetLabel == "port" {
+			return nil, errors.Errorf("Relabel rule of services can't set '%s', it is the scrape address", rule.TargetLabel)
+		}
+	}
+
+	return NewRelabelRules(rules)
+}
+
+// Compile validates the rule, sets defaults and compiles its regex
+func (r *RelabelRule) Compile() error {
+	if len(r.Action) == 0 {
+		r.Action = relabelReplace
+	}
+	if len(r.Regex) == 0 {
+		r.Regex = defaultRelabelRegex
+	}
+	if len(r.Separator) == 0 {
+		r.Separator = defaultRelabelSeparator
+	}
+	r.replacement = defaultRelabelReplacement
+	if r.Replacement != nil {
+		r.replacement = *r.Replacement
+	}
+
+	switch r.Action {
+	case relabelReplace:
+		if len(r.TargetLabel) == 0 {
+			return errors.Errorf("Missing target_label of '%s' relabel rule", r.Action)
+		}
+	case relabelHashMod:
+		if len(r.TargetLabel) == 0 || r.Modulus == 0 {
+			return errors.Errorf("Relabel rule 'hashmod' requires target_label and modulus")
+		}
+	case relabelKeep, relabelDrop, relabelLabelMap, relabelLabelDrop, relabelLabelKeep:
+	default:
+		return errors.Errorf("Unknown relabel action: %s", r.Action)
+	}
+
+	re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return errors.WrapPrefix(err, "Invalid relabel regex: "+r.Regex, 0)
+	}
+	r.re = re
+
+	return nil
+}
+
+// apply rewrites labels in place, false is returned when the target should be dropped
+func (r RelabelRule) apply(labels map[string]string) bool {
+	if r.re == nil {
+		if err := r.Compile(); err != nil {
+			log.WithError(err).Error("Error applying relabel rule - skipping")
+			return true
+		}
+	}
+	re := r.re
+
+	values := make([]string, len(r.SourceLabels))
+	for i, name := range r.SourceLabels {
+		values[i] = labels[name]
+	}
+	value := strings.Join(values, r.Separator)
+
+	switch r.Action {
+	case relabelReplace:
+		indexes := re.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			break
+		}
+		target := string(re.ExpandString(nil, r.TargetLabel, value, indexes))
+		result := string(re.ExpandString(nil, r.replacement, value, indexes))
+		if len(result) == 0 {
+			delete(labels, target)
+		} else {
+			labels[target] = result
+		}
+	case relabelKeep:
+		return re.MatchString(value)
+	case relabelDrop:
+		return !re.MatchString(value)
+	case relabelHashMod:
+		sum := md5.Sum([]byte(value))
+		labels[r.TargetLabel] = strconv.FormatUint(binary.BigEndian.Uint64(sum[8:])%r.Modulus, 10)
+	case relabelLabelMap:
+		mapped := map[string]string{}
+		for name, v := range labels {
+			if re.MatchString(name) {
+				mapped[re.ReplaceAllString(name, r.replacement)] = v
+			}
+		}
+		for name, v := range mapped {
+			labels[name] = v
+		}
+	case relabelLabelDrop, relabelLabelKeep:
+		for name := range labels {
+			// metrics without measurement can't be sent, it is removed by replace only
+			if name == LabelMeasurement {
+				continue
+			}
+			if re.MatchString(name) == (r.Action == relabelLabelDrop) {
+				delete(labels, name)
+			}
+		}
+	}
+
+	return true
+}
+
+// Relabel applies all the rules to labels in place, false is returned when the target should be dropped
+func (rs RelabelRules) Relabel(labels map[string]string) bool {
+	for _, rule := range rs {
+		if !rule.apply(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Services relabels services before their metrics are fetched, dropped services are not returned.
+//
+// Labels of a service are service_name, service_id, host, port, format, path, labels of its Marathon app
+// prefixed with __label_ and its tags prefixed with __tag_. Host and port are the scrape address, they are kept
+// as discovered.
+func (rs RelabelRules) Services(services []ServiceInfo) []ServiceInfo {
+	if len(rs) == 0 {
+		return services
+	}
+
+	result := []ServiceInfo{}
+	for _, service := range services {
+		labels := map[string]string{
+			"service_name": service.Name,
+			"service_id":   service.ID,
+			"host":         service.Host,
+			"port":         strconv.FormatInt(service.Port, 10),
+			"format":       service.Format,
+			"path":         service.Path,
+		}
+		for k, v := range service.Labels {
+			labels[LabelMarathonPrefix+k] = v
+		}
+		for k, v := range service.Tags {
+			labels[LabelTagPrefix+k] = v
+		}
+
+		if !rs.Relabel(labels) {
+			continue
+		}
+
+		relabeled := ServiceInfo{
+			Name:   labels["service_name"],
+			ID:     labels["service_id"],
+			Host:   service.Host,
+			Port:   service.Port,
+			Format: labels["format"],
+			Path:   labels["path"],
+		}
+		for k, v := range labels {
+			switch {
+			case strings.HasPrefix(k, LabelMarathonPrefix):
+				if relabeled.Labels == nil {
+					relabeled.Labels = map[string]string{}
+				}
+				relabeled.Labels[strings.TrimPrefix(k, LabelMarathonPrefix)] = v
+			case strings.HasPrefix(k, LabelTagPrefix):
+				if relabeled.Tags == nil {
+					relabeled.Tags = map[string]string{}
+				}
+				relabeled.Tags[strings.TrimPrefix(k, LabelTagPrefix)] = v
+			}
+		}
+
+		result = append(result, relabeled)
+	}
+
+	return result
+}
+
+// Metrics relabels filtered metrics before they are sent, dropped metrics are not returned.
+//
+// Labels of a metric are its tags and the measurement name as __measurement__, labels starting with "__"
+// are not kept as tags.
+func (rs RelabelRules) Metrics(metrics []FilteredMetrics) []FilteredMetrics {
+	if len(rs) == 0 {
+		return metrics
+	}
+
+	result := []FilteredMetrics{}
+	for _, metric := range metrics {
+		labels := map[string]string{LabelMeasurement: metric.Measurement}
+		for k, v := range metric.Tags {
+			labels[k] = v
+		}
+
+		if !rs.Relabel(labels) {
+			continue
+		}
+		if len(labels[LabelMeasurement]) == 0 {
+			log.WithField("tags", metric.Tags).Warn("Dropping metric relabeled without measurement")
+			continue
+		}
+
+		relabeled := FilteredMetrics{Measurement: labels[LabelMeasurement], Tags: map[string]string{}, Fields: metric.Fields, Group: metric.Group, Renamed: metric.Renamed}
+		for k, v := range labels {
+			if !strings.HasPrefix(k, labelInternalPrefix) {
+				relabeled.Tags[k] = v
+			}
+		}
+
+		result = append(result, relabeled)
+	}
+
+	return result
+}
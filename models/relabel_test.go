@@ -0,0 +1,170 @@
+package models_test
+
+import (
+	. "github.com/Wikia/metrics-fetcher/models"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RelabelRules", func() {
+	replacement := func(value string) *string {
+		return &value
+	}
+	metric := func(measurement string, tags map[string]string) FilteredMetrics {
+		return FilteredMetrics{Measurement: measurement, Tags: tags, Fields: map[string]interface{}{"value": 1.0}}
+	}
+
+	Describe("Metrics()", func() {
+		metrics := []FilteredMetrics{
+			metric("jvm_memory", map[string]string{"service_name": "/prod/discussion", "host": "10.8.0.1", "metric_name": "heap"}),
+			metric("http_debug", map[string]string{"service_name": "/prod/discussion", "host": "10.8.0.2", "metric_name": "debug"}),
+		}
+
+		It("Should replace, copy and drop", func() {
+			rules, err := NewRelabelRules([]RelabelRule{
+				{SourceLabels: []string{"__measurement__"}, Regex: "http_debug", Action: "drop"},
+				{SourceLabels: []string{"service_name"}, Regex: "/(.*)", TargetLabel: "service_name"},
+				{SourceLabels: []string{"service_name"}, Regex: "/", Replacement: replacement("_"), TargetLabel: "unused"},
+				{SourceLabels: []string{"host"}, Regex: "10\\.8\\.0\\.(\\d+)", TargetLabel: "host", Replacement: replacement("node-$1")},
+				{SourceLabels: []string{"service_name", "metric_name"}, Separator: ".", TargetLabel: "series"},
+				{SourceLabels: []string{"metric_name"}, TargetLabel: "__measurement__", Replacement: replacement("jvm_${1}")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := rules.Metrics(metrics)
+
+			Expect(result).To(Equal([]FilteredMetrics{
+				metric("jvm_heap", map[string]string{
+					"service_name": "prod/discussion",
+					"host":         "node-1",
+					"metric_name":  "heap",
+					"series":       "prod/discussion.heap",
+				}),
+			}))
+			Expect(metrics[0].Tags["service_name"]).To(Equal("/prod/discussion"))
+		})
+
+		It("Should keep only matching metrics", func() {
+			rules, err := NewRelabelRules([]RelabelRule{{SourceLabels: []string{"metric_name"}, Regex: "heap|nonheap", Action: "keep"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := rules.Metrics(metrics)
+
+			Expect(result).To(HaveLen(1))
+			Expect(result[0].Tags["metric_name"]).To(Equal("heap"))
+		})
+
+		It("Should map and drop labels", func() {
+			rules, err := NewRelabelRules([]RelabelRule{
+				{Regex: "(service|metric)_name", Replacement: replacement("${1}"), Action: "labelmap"},
+				{Regex: "host|.*_name", Action: "labeldrop"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := rules.Metrics(metrics[:1])
+
+			Expect(result[0].Measurement).To(Equal("jvm_memory"))
+			Expect(result[0].Tags).To(Equal(map[string]string{"service": "/prod/discussion", "metric": "heap"}))
+		})
+
+		It("Should keep measurement on labelkeep and labeldrop", func() {
+			rules, err := NewRelabelRules([]RelabelRule{
+				{Regex: "host", Action: "labelkeep"},
+				{Regex: "__.*", Action: "labeldrop"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := rules.Metrics(metrics[:1])
+
+			Expect(result).To(Equal([]FilteredMetrics{metric("jvm_memory", map[string]string{"host": "10.8.0.1"})}))
+		})
+
+		It("Should remove labels replaced with empty value and drop metrics without measurement", func() {
+			rules, err := NewRelabelRules([]RelabelRule{
+				{TargetLabel: "host", Replacement: replacement("")},
+				{SourceLabels: []string{"metric_name"}, Regex: "debug", TargetLabel: "__measurement__", Replacement: replacement("")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := rules.Metrics(metrics)
+
+			Expect(result).To(Equal([]FilteredMetrics{
+				metric("jvm_memory", map[string]string{"service_name": "/prod/discussion", "metric_name": "heap"}),
+			}))
+		})
+
+		It("Should shard by hash", func() {
+			rules, err := NewRelabelRules([]RelabelRule{
+				{SourceLabels: []string{"host"}, Modulus: 4, TargetLabel: "__shard", Action: "hashmod"},
+				{SourceLabels: []string{"__shard"}, Regex: "0|1", Action: "keep"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			kept := 0
+			for i := 0; i < 100; i++ {
+				host := string(rune('a'+i%26)) + string(rune('a'+i/26))
+				result := rules.Metrics([]FilteredMetrics{metric("test", map[string]string{"host": host})})
+				if len(result) != 0 {
+					Expect(result[0].Tags).NotTo(HaveKey("__shard"))
+					kept++
+				}
+			}
+			Expect(kept).To(BeNumerically(">", 20))
+			Expect(kept).To(BeNumerically("<", 80))
+
+			first := rules.Metrics([]FilteredMetrics{metric("test", map[string]string{"host": "aa"})})
+			second := rules.Metrics([]FilteredMetrics{metric("test", map[string]string{"host": "aa"})})
+			Expect(first).To(Equal(second))
+		})
+	})
+
+	Describe("Services()", func() {
+		services := []ServiceInfo{
+			{Name: "/prod/discussion", ID: "1", Host: "10.8.0.1", Port: 31000, Labels: map[string]string{"team": "core"}},
+			{Name: "/dev/discussion", ID: "2", Host: "10.8.0.2", Port: 31001},
+		}
+
+		It("Should relabel and drop services before scraping", func() {
+			rules, err := NewServiceRelabelRules([]RelabelRule{
+				{SourceLabels: []string{"service_name"}, Regex: "/dev/.*", Action: "drop"},
+				{SourceLabels: []string{"service_name"}, Regex: "/(.*)", TargetLabel: "service_name"},
+				{SourceLabels: []string{"__label_team"}, Regex: "core", TargetLabel: "__label_owner", Replacement: replacement("platform")},
+				{SourceLabels: []string{"port"}, TargetLabel: "path", Replacement: replacement("/metrics/$1")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := rules.Services(services)
+
+			Expect(result).To(Equal([]ServiceInfo{
+				{Name: "prod/discussion", ID: "1", Host: "10.8.0.1", Port: 31000, Path: "/metrics/31000", Labels: map[string]string{"team": "core", "owner": "platform"}},
+			}))
+		})
+
+		It("Should keep the scrape address as discovered", func() {
+			_, err := NewServiceRelabelRules([]RelabelRule{{TargetLabel: "host", Replacement: replacement("node-1")}})
+			Expect(err).To(HaveOccurred())
+			_, err = NewServiceRelabelRules([]RelabelRule{{SourceLabels: []string{"host"}, Modulus: 4, TargetLabel: "port", Action: "hashmod"}})
+			Expect(err).To(HaveOccurred())
+
+			rules, err := NewServiceRelabelRules([]RelabelRule{{Regex: "host|port", Action: "labeldrop"}})
+			Expect(err).NotTo(HaveOccurred())
+
+			result := rules.Services(services)
+			Expect(result[0].Host).To(Equal("10.8.0.1"))
+			Expect(result[0].Port).To(Equal(int64(31000)))
+		})
+	})
+
+	It("Should reject invalid rules", func() {
+		for _, rule := range []RelabelRule{
+			{Action: "replace"},
+			{Action: "hashmod", TargetLabel: "shard"},
+			{Action: "unknown"},
+			{Action: "keep", Regex: "("},
+		} {
+			_, err := NewRelabelRules([]RelabelRule{rule})
+			Expect(err).To(HaveOccurred(), rule.Action)
+		}
+	})
+})
@@ -0,0 +1,56 @@
+package registry
+
+import "strings"
+
+const defaultAppIDSeparator = "/"
+
+// AppIDMapping decomposes hierarchical Marathon app IDs (e.g. /prod/discussion/api) into tags.
+//
+// Segments of the app ID are assigned to Tags from the left (empty names skip a segment), segments left over
+// are joined into the last tag with Separator ("/" by default). The service name is the app ID without the leading
+// slash with segments joined by Separator.
+type AppIDMapping struct {
+	Tags      []string
+	Separator string
+}
+
+// Apply returns normalized service name and tags of an app ID
+func (m AppIDMapping) Apply(appID string) (string, map[string]string) {
+	if len(m.Tags) == 0 && len(m.Separator) == 0 {
+		return appID, nil
+	}
+
+	separator := m.Separator
+	if len(separator) == 0 {
+		separator = defaultAppIDSeparator
+	}
+
+	segments := []string{}
+	for _, segment := range strings.Split(appID, "/") {
+		if len(segment) != 0 {
+			segments = append(segments, segment)
+		}
+	}
+
+	name := strings.Join(segments, separator)
+	if len(m.Tags) == 0 {
+		return name, nil
+	}
+
+	tags := map[string]string{}
+	for i, tag := range m.Tags {
+		if i >= len(segments) {
+			break
+		}
+
+		value := segments[i]
+		if i == len(m.Tags)-1 {
+			value = strings.Join(segments[i:], separator)
+		}
+		if len(tag) != 0 {
+			tags[tag] = value
+		}
+	}
+
+	return name, tags
+}
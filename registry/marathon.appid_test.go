@@ -0,0 +1,45 @@
+package registry_test
+
+import (
+	. "github.com/Wikia/metrics-fetcher/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AppIDMapping", func() {
+	It("Should keep app IDs without tags", func() {
+		name, tags := AppIDMapping{}.Apply("/prod/discussion/api")
+
+		Expect(name).To(Equal("/prod/discussion/api"))
+		Expect(tags).To(BeNil())
+	})
+
+	It("Should map segments to tags", func() {
+		mapping := AppIDMapping{Tags: []string{"env", "group", "app"}}
+
+		name, tags := mapping.Apply("/prod/discussion/api")
+		Expect(name).To(Equal("prod/discussion/api"))
+		Expect(tags).To(Equal(map[string]string{"env": "prod", "group": "discussion", "app": "api"}))
+
+		name, tags = mapping.Apply("/prod/discussion")
+		Expect(name).To(Equal("prod/discussion"))
+		Expect(tags).To(Equal(map[string]string{"env": "prod", "group": "discussion"}))
+	})
+
+	It("Should join remaining segments and skip unnamed ones", func() {
+		mapping := AppIDMapping{Tags: []string{"", "app"}, Separator: "."}
+
+		name, tags := mapping.Apply("/prod/discussion/api/v2")
+
+		Expect(name).To(Equal("prod.discussion.api.v2"))
+		Expect(tags).To(Equal(map[string]string{"app": "discussion.api.v2"}))
+	})
+
+	It("Should normalize names with separator only", func() {
+		name, tags := AppIDMapping{Separator: "."}.Apply("/prod/discussion/api")
+
+		Expect(name).To(Equal("prod.discussion.api"))
+		Expect(tags).To(BeNil())
+	})
+})
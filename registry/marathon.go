@@ -11,10 +11,19 @@ import (
 	"gopkg.in/go-playground/pool.v3"
 )
 
+const (
+	// LabelMetricsFormat is the Marathon app label selecting the input format of the metrics endpoint
+	LabelMetricsFormat = "metrics-format"
+	// LabelMetricsPath is the Marathon app label overriding the path of the metrics endpoint
+	LabelMetricsPath = "metrics-path"
+)
+
 // MarathonRegistry is the structure used to fetch services from Marathon
 type MarathonRegistry struct {
 	client    marathon.Marathon
 	MaxWorker uint
+	// AppID maps app IDs to service names and tags
+	AppID AppIDMapping
 }
 
 // NewMarathonRegistry creates new MarathonRegistry instance and instantiates API client
@@ -39,7 +48,7 @@ func NewMarathonRegistry(host string, numWorkers uint, client *http.Client) (*Ma
 	}, nil
 }
 
-func fetchServiceTasks(client marathon.Marathon, appID string) pool.WorkFunc {
+func fetchServiceTasks(client marathon.Marathon, appID string, mapping AppIDMapping) pool.WorkFunc {
 	return func(wu pool.WorkUnit) (interface{}, error) {
 		log.WithField("app_id", appID).Debug("Fetching tasks")
 
@@ -54,8 +63,14 @@ func fetchServiceTasks(client marathon.Marathon, appID string) pool.WorkFunc {
 			return nil, nil
 		}
 
+		var labels map[string]string
+		if details.Labels != nil {
+			labels = *details.Labels
+		}
+
 		result := []models.ServiceInfo{}
 		for _, task := range details.Tasks {
+			name, tags := mapping.Apply(task.AppID)
 			log.WithField("app_id", appID).Debug("Adding task: ", task.ID)
 			if len(task.Ports) == 0 {
 				log.WithField("app_id", appID).Warn("Service has no ports defined: skipping")
@@ -63,10 +78,14 @@ func fetchServiceTasks(client marathon.Marathon, appID string) pool.WorkFunc {
 			}
 
 			result = append(result, models.ServiceInfo{
-				Name: task.AppID,
-				ID:   task.ID,
-				Host: task.Host,
-				Port: int64(task.Ports[len(task.Ports)-1]),
+				Name:   name,
+				ID:     task.ID,
+				Host:   task.Host,
+				Port:   int64(task.Ports[len(task.Ports)-1]),
+				Format: labels[LabelMetricsFormat],
+				Path:   labels[LabelMetricsPath],
+				Labels: labels,
+				Tags:   tags,
 			})
 		}
 		log.WithField("app_id", appID).Debug("Finished adding tasks")
@@ -94,7 +113,7 @@ func (c MarathonRegistry) GetServices(label string) ([]models.ServiceInfo, error
 	go func() {
 		for i, app := range apps.Apps {
 			log.Debugf("Found application '%s' (%d)", app.ID, i+1)
-			batch.Queue(fetchServiceTasks(c.client, app.ID))
+			batch.Queue(fetchServiceTasks(c.client, app.ID, c.AppID))
 		}
 		batch.QueueComplete()
 	}()
@@ -72,5 +72,17 @@ var _ = Describe("Marathon", func() {
 			Expect(services).To(HaveLen(2))
 			Expect(services).To(ConsistOf(expectedServices))
 		})
+
+		It("Should map app IDs to service names and tags", func() {
+			marathon.AppID = AppIDMapping{Tags: []string{"app"}}
+			services, err := marathon.GetServices("test")
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(services).To(HaveLen(2))
+			for _, service := range services {
+				Expect(service.Name).To(Equal("toggle"))
+				Expect(service.Tags).To(Equal(map[string]string{"app": "toggle"}))
+			}
+		})
 	})
 })